@@ -3,34 +3,124 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/zgiber/topspenders/parse"
 )
 
+// dateFlagLayout is the layout of the -from and -to dates.
+const dateFlagLayout = "2006-01-02"
+
 func main() {
-	stopOnError := flag.Bool("stop-on-error", false, "Stop processing on the first parsing error")
-	flag.Parse()
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	if len(flag.Args()) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: topspenders [-stop-on-error] <input.csv>")
-		os.Exit(1)
+// run executes the CLI with the given arguments and streams, returning the
+// process exit code. An input path of "-" reads from stdin.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("topspenders", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	stopOnError := flags.Bool("stop-on-error", false, "Stop processing on the first parsing error")
+	rejectsPath := flags.String("rejects", "", "Write skipped input rows with their errors to this file")
+	var topN int
+	flags.IntVar(&topN, "top-n", 0, "Number of spenders ranked per month, negative for every spender (default 5)")
+	flags.IntVar(&topN, "top", 0, "Alias of -top-n")
+	format := flags.String("format", "csv", "Output format: csv, "+parse.OutputFormatJSON+", "+parse.OutputFormatJSONNested+", "+parse.OutputFormatMonthSummaryJSONL+" or "+parse.OutputFormatMatrix)
+	order := flags.String("order", parse.OrderDesc, "Rank the top spenders with desc, the bottom ones with asc")
+	minAmount := flags.Float64("min-amount", 0, "Ignore transactions worth less than this in GBP, e.g. 0.01 to skip refunds")
+	from := flags.String("from", "", "Only count transactions from this day, as YYYY-MM-DD")
+	to := flags.String("to", "", "Only count transactions until the end of this day, as YYYY-MM-DD")
+	logLevel := flags.String("log-level", os.Getenv("TOPSPENDERS_LOG_LEVEL"), "Lowest level logged: debug, info, warn or error (default from TOPSPENDERS_LOG_LEVEL, else info)")
+	if err := flags.Parse(args); err != nil {
+		return 2
 	}
-	filePath := flag.Args()[0]
 
-	inputFile, err := os.Open(filePath)
+	var level slog.Level
+	if *logLevel != "" {
+		if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+			fmt.Fprintf(stderr, "invalid log level %q: %v\n", *logLevel, err)
+			return 2
+		}
+	}
+	fromDate, err := parseDateFlag(*from)
 	if err != nil {
-		slog.Error("failed to open input file", "path", filePath, "error", err)
-		os.Exit(1)
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	toDate, err := parseDateFlag(*to)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if !toDate.IsZero() {
+		// The whole day is included.
+		toDate = toDate.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level}))
+
+	if len(flags.Args()) < 1 {
+		fmt.Fprintln(stderr, "Usage: topspenders [-stop-on-error] [-rejects <path>] [-top-n <n>] [-format <format>] [-order <order>] [-min-amount <gbp>] [-from <date>] [-to <date>] [-log-level <level>] <input.csv[.gz]>")
+		return 1
+	}
+	filePath := flags.Args()[0]
+
+	input := stdin
+	if filePath != "-" {
+		inputFile, err := os.Open(filePath)
+		if err != nil {
+			logger.Error("failed to open input file", "path", filePath, "error", err)
+			return 1
+		}
+		defer inputFile.Close()
+		input = inputFile
+	}
+	input, err = parse.Decompress(input)
+	if err != nil {
+		logger.Error("failed to read input", "path", filePath, "error", err)
+		return 1
 	}
-	defer inputFile.Close()
 
 	cfg := parse.Config{
-		StopOnError: *stopOnError,
+		StopOnError:       *stopOnError,
+		Logger:            logger,
+		ReuseTransactions: true,
+		TopN:              topN,
+		OutputFormat:      *format,
+		Order:             *order,
+		MinAmount:         *minAmount,
+		From:              fromDate,
+		To:                toDate,
+	}
+
+	if *rejectsPath != "" {
+		rejectsFile, err := os.Create(*rejectsPath)
+		if err != nil {
+			logger.Error("failed to create rejects file", "path", *rejectsPath, "error", err)
+			return 1
+		}
+		defer rejectsFile.Close()
+		cfg.RejectsWriter = rejectsFile
+	}
+
+	if err := parse.TopSpenders(input, stdout, cfg); err != nil {
+		logger.Error("failed to process transactions", "error", err)
+		return 1
 	}
-	if err := parse.TopSpenders(inputFile, os.Stdout, cfg); err != nil {
-		slog.Error("failed to process transactions", "error", err)
-		os.Exit(1)
+	return 0
+}
+
+// parseDateFlag parses the value of a date flag, where empty is the zero time.
+func parseDateFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse(dateFlagLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: %w", value, err)
 	}
+	return date, nil
 }
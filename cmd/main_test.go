@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const malformedCSV = `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
+`
+
+const twoSpendersCSV = `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00
+`
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	inputPath := filepath.Join(t.TempDir(), "transactions.csv")
+	if err := os.WriteFile(inputPath, []byte(malformedCSV), 0o600); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	if _, err := gz.Write([]byte(twoSpendersCSV)); err != nil {
+		t.Fatalf("failed to compress input: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("failed to compress input: %v", err)
+	}
+	gzipPath := filepath.Join(t.TempDir(), "transactions.csv.gz")
+	if err := os.WriteFile(gzipPath, gzipped.Bytes(), 0o600); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		args           []string
+		stdin          string
+		wantCode       int
+		expectedStdout string
+		wantStderr     string
+		// unwantedStderr must not be logged, when set.
+		unwantedStderr string
+	}{
+		{
+			name:       "missing args",
+			args:       nil,
+			wantCode:   1,
+			wantStderr: "Usage: topspenders",
+		},
+		{
+			name:       "unknown flag",
+			args:       []string{"-no-such-flag", inputPath},
+			wantCode:   2,
+			wantStderr: "flag provided but not defined",
+		},
+		{
+			name:       "help lists every format",
+			args:       []string{"-h"},
+			wantCode:   2,
+			wantStderr: "csv, json, json-nested, month-summary-jsonl or matrix",
+		},
+		{
+			name:       "bad file path",
+			args:       []string{filepath.Join(t.TempDir(), "missing.csv")},
+			wantCode:   1,
+			wantStderr: "failed to open input file",
+		},
+		{
+			name:     "happy path skips malformed rows",
+			args:     []string{inputPath},
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`,
+			wantStderr: "input error",
+		},
+		{
+			name:       "stop on error",
+			args:       []string{"-stop-on-error", inputPath},
+			wantCode:   1,
+			wantStderr: "failed to process transactions",
+		},
+		{
+			name:     "log level above errors",
+			args:     []string{"-log-level", "ERROR+4", inputPath},
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`,
+			unwantedStderr: "input error",
+		},
+		{
+			name:       "invalid log level",
+			args:       []string{"-log-level", "loud", inputPath},
+			wantCode:   2,
+			wantStderr: "invalid log level",
+		},
+		{
+			name:     "top n",
+			args:     []string{"-top-n", "1", "-"},
+			stdin:    twoSpendersCSV,
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+		{
+			name:     "top alias",
+			args:     []string{"-top", "1", "-"},
+			stdin:    twoSpendersCSV,
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+		{
+			name:     "json format",
+			args:     []string{"-format", "json", "-"},
+			stdin:    twoSpendersCSV,
+			wantCode: 0,
+			expectedStdout: `[{"date":"2024/01","rank":1,"amount":200.0000000,"currency":"GBP","transactions":1,"email":"b@test.com","firstName":"B","lastName":"B"},` +
+				`{"date":"2024/01","rank":2,"amount":100.0000000,"currency":"GBP","transactions":1,"email":"a@test.com","firstName":"A","lastName":"A"}]` + "\n",
+		},
+		{
+			name:       "unknown format",
+			args:       []string{"-format", "xml", "-"},
+			stdin:      twoSpendersCSV,
+			wantCode:   1,
+			wantStderr: "unknown output format: xml",
+		},
+		{
+			name:     "ascending order",
+			args:     []string{"-order", "asc", "-top-n", "1", "-"},
+			stdin:    twoSpendersCSV,
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`,
+		},
+		{
+			name:       "unknown order",
+			args:       []string{"-order", "up", "-"},
+			stdin:      twoSpendersCSV,
+			wantCode:   1,
+			wantStderr: "unknown order: up",
+		},
+		{
+			name:     "min amount",
+			args:     []string{"-min-amount", "150", "-"},
+			stdin:    twoSpendersCSV,
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+		{
+			name:     "date range",
+			args:     []string{"-from", "2024-01-11", "-to", "2024-01-11", "-"},
+			stdin:    twoSpendersCSV,
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+		{
+			name:       "invalid date",
+			args:       []string{"-from", "11/01/2024", "-"},
+			stdin:      twoSpendersCSV,
+			wantCode:   2,
+			wantStderr: "invalid date",
+		},
+		{
+			name:     "gzip file",
+			args:     []string{"-top-n", "1", gzipPath},
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+		{
+			name:     "gzip stdin",
+			args:     []string{"-top-n", "1", "-"},
+			stdin:    gzipped.String(),
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+		{
+			name:       "malformed gzip",
+			args:       []string{"-"},
+			stdin:      "\x1f\x8bnot gzip",
+			wantCode:   1,
+			wantStderr: "invalid gzip input",
+		},
+		{
+			name:     "reads stdin",
+			args:     []string{"-"},
+			stdin:    malformedCSV,
+			wantCode: 0,
+			expectedStdout: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			code := run(tc.args, strings.NewReader(tc.stdin), stdout, stderr)
+			if code != tc.wantCode {
+				t.Errorf("expected exit code %d, got %d (stderr: %s)", tc.wantCode, code, stderr.String())
+			}
+
+			if stdout.String() != tc.expectedStdout {
+				t.Errorf("stdout does not match expected value.\nGot:\n%s\nExpected:\n%s", stdout.String(), tc.expectedStdout)
+			}
+
+			if !strings.Contains(stderr.String(), tc.wantStderr) {
+				t.Errorf("expected stderr to contain %q, got: %s", tc.wantStderr, stderr.String())
+			}
+
+			if tc.unwantedStderr != "" && strings.Contains(stderr.String(), tc.unwantedStderr) {
+				t.Errorf("expected stderr not to contain %q, got: %s", tc.unwantedStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRun_logLevelEnv(t *testing.T) {
+	inputPath := filepath.Join(t.TempDir(), "transactions.csv")
+	if err := os.WriteFile(inputPath, []byte(malformedCSV), 0o600); err != nil {
+		t.Fatalf("failed to write input file: %v", err)
+	}
+	t.Setenv("TOPSPENDERS_LOG_LEVEL", "ERROR+4")
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := run([]string{inputPath}, strings.NewReader(""), stdout, stderr); code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	if stderr.Len() > 0 {
+		t.Errorf("expected nothing logged, got: %s", stderr.String())
+	}
+}
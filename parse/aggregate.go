@@ -0,0 +1,379 @@
+package parse
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// defaultSpillLimit is the number of user-month aggregates held in memory
+// before spilling when spilling is enabled but Config.SpillLimit is not set.
+const defaultSpillLimit = 1_000_000
+
+// aggregator accumulates card spending per month and user.
+//
+// When Config.SpillDir or Config.ExternalSort is set, at most
+// Config.SpillLimit aggregates are held in memory while reading the input.
+// Beyond that, the partial aggregates are written to temp files as runs
+// sorted by user, one per month and spill, and merged back one month at a
+// time when the results are read, so the memory used for writing the report
+// is bounded by the largest month rather than by the whole input. With
+// Config.ExternalSort, the runs of a month are merged as streams keeping only
+// the top spenders, see topOfMonth.
+type aggregator struct {
+	cfg *Config
+
+	// yearmonth:userKey:spending
+	months   map[int]map[string]*UserMonthlySpending
+	inMemory int
+
+	// month -> spill files holding partial aggregates of that month.
+	spillFiles map[int][]string
+}
+
+// spillRecord is the on-disk form of a partial UserMonthlySpending.
+type spillRecord struct {
+	Spending    UserMonthlySpending
+	ExactGBP    *big.Rat
+	Merchants   map[string]bool
+	WeightedGBP float64
+	ActiveDays  uint32
+}
+
+func newAggregator(cfg *Config) *aggregator {
+	return &aggregator{
+		cfg:        cfg,
+		months:     map[int]map[string]*UserMonthlySpending{},
+		spillFiles: map[int][]string{},
+	}
+}
+
+// add accounts tx to the spending of its user and month.
+func (a *aggregator) add(tx *Transaction) error {
+	key := a.cfg.periodKey(tx.Date)
+	// Initialise the nested map if it is an unseen month
+	month, ok := a.months[key]
+	if !ok {
+		month = map[string]*UserMonthlySpending{}
+		a.months[key] = month
+	}
+
+	category := a.cfg.category(tx)
+	userKey := spendingKey(category, tx.Email)
+	userSpendings, ok := month[userKey]
+	if !ok {
+		userSpendings = &UserMonthlySpending{
+			FirstName: tx.FirstName,
+			LastName:  tx.LastName,
+			Email:     tx.Email,
+			Category:  category,
+		}
+		month[userKey] = userSpendings
+		a.inMemory++
+	}
+	userSpendings.update(tx, a.cfg)
+
+	if a.spilling() && a.inMemory > a.spillLimit() {
+		return a.spill()
+	}
+	return nil
+}
+
+// spilling reports whether aggregates are spilled to disk beyond the limit.
+func (a *aggregator) spilling() bool {
+	return a.cfg.SpillDir != "" || a.cfg.ExternalSort
+}
+
+func (a *aggregator) spillLimit() int {
+	if a.cfg.SpillLimit > 0 {
+		return a.cfg.SpillLimit
+	}
+	return defaultSpillLimit
+}
+
+// spill moves every in-memory aggregate to disk, as a run of the month
+// sorted by user key.
+func (a *aggregator) spill() error {
+	for key, month := range a.months {
+		// An empty SpillDir is the default temp directory.
+		f, err := os.CreateTemp(a.cfg.SpillDir, fmt.Sprintf("topspenders-%d-*.spill", key))
+		if err != nil {
+			return fmt.Errorf("creating spill file: %w", err)
+		}
+		a.spillFiles[key] = append(a.spillFiles[key], f.Name())
+
+		enc := gob.NewEncoder(f)
+		for _, userKey := range slices.Sorted(maps.Keys(month)) {
+			us := month[userKey]
+			if err := enc.Encode(spillRecord{Spending: *us, ExactGBP: us.exactGBP, Merchants: us.merchants, WeightedGBP: us.weightedGBP, ActiveDays: us.activeDays}); err != nil {
+				f.Close()
+				return fmt.Errorf("writing spill file: %w", err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("writing spill file: %w", err)
+		}
+	}
+
+	a.months = map[int]map[string]*UserMonthlySpending{}
+	a.inMemory = 0
+	return nil
+}
+
+// monthKeys returns the keys of all months seen, in ascending order.
+func (a *aggregator) monthKeys() []int {
+	keys := make([]int, 0, len(a.months)+len(a.spillFiles))
+	for key := range a.months {
+		keys = append(keys, key)
+	}
+	for key := range a.spillFiles {
+		if _, ok := a.months[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// month returns the spending of every user in the month, keyed by
+// UserMonthlySpending.key.
+// Spilled months are loaded from disk on every call; otherwise the result is
+// the aggregator's own map.
+func (a *aggregator) month(key int) (map[string]*UserMonthlySpending, error) {
+	files := a.spillFiles[key]
+	if len(files) == 0 {
+		return a.months[key], nil
+	}
+
+	month := map[string]*UserMonthlySpending{}
+	for _, path := range files {
+		if err := loadSpillFile(path, month); err != nil {
+			return nil, err
+		}
+	}
+	for userKey, us := range a.months[key] {
+		mergeSpending(month, userKey, us)
+	}
+	return month, nil
+}
+
+func loadSpillFile(path string, month map[string]*UserMonthlySpending) error {
+	run, err := openSpillRun(path)
+	if err != nil {
+		return err
+	}
+	defer run.close()
+
+	for run.head != nil {
+		mergeSpending(month, run.head.key(), run.head)
+		if err := run.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeSpending adds us to the spending held for userKey in month.
+func mergeSpending(month map[string]*UserMonthlySpending, userKey string, us *UserMonthlySpending) {
+	existing, ok := month[userKey]
+	if !ok {
+		month[userKey] = cloneSpending(us)
+		return
+	}
+	existing.merge(us)
+}
+
+// cloneSpending returns a copy of us sharing no state with it.
+func cloneSpending(us *UserMonthlySpending) *UserMonthlySpending {
+	c := *us
+	if us.exactGBP != nil {
+		c.exactGBP = new(big.Rat).Set(us.exactGBP)
+	}
+	if us.merchants != nil {
+		c.merchants = maps.Clone(us.merchants)
+	}
+	return &c
+}
+
+// sortedRun yields the partial spendings of a month by ascending user key,
+// from a spill file or from memory. head is nil once the run is exhausted.
+type sortedRun struct {
+	head  *UserMonthlySpending
+	next  func() error
+	close func() error
+}
+
+func openSpillRun(path string) (*sortedRun, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading spill file: %w", err)
+	}
+
+	dec := gob.NewDecoder(f)
+	run := &sortedRun{close: f.Close}
+	run.next = func() error {
+		var record spillRecord
+		if err := dec.Decode(&record); err != nil {
+			run.head = nil
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("reading spill file: %w", err)
+		}
+		us := record.Spending
+		us.exactGBP = record.ExactGBP
+		us.merchants = record.Merchants
+		us.weightedGBP = record.WeightedGBP
+		us.activeDays = record.ActiveDays
+		run.head = &us
+		return nil
+	}
+	if err := run.next(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return run, nil
+}
+
+// memoryRun returns the in-memory spendings of month as a sorted run.
+func memoryRun(month map[string]*UserMonthlySpending) *sortedRun {
+	keys := slices.Sorted(maps.Keys(month))
+	run := &sortedRun{close: func() error { return nil }}
+	run.next = func() error {
+		run.head = nil
+		if len(keys) > 0 {
+			run.head, keys = month[keys[0]], keys[1:]
+		}
+		return nil
+	}
+	run.next()
+	return run
+}
+
+// mergeRuns calls visit with the spending of every user of the month,
+// merging the sorted runs of the month as streams so that a single user's
+// spending is held in memory at a time. The spendings passed to visit are
+// not retained by the aggregator.
+func (a *aggregator) mergeRuns(key int, visit func(us *UserMonthlySpending)) (err error) {
+	runs := []*sortedRun{memoryRun(a.months[key])}
+	defer func() {
+		for _, run := range runs {
+			err = errors.Join(err, run.close())
+		}
+	}()
+	for _, path := range a.spillFiles[key] {
+		run, err := openSpillRun(path)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+
+	for {
+		var userKey string
+		found := false
+		for _, run := range runs {
+			if run.head != nil && (!found || run.head.key() < userKey) {
+				userKey, found = run.head.key(), true
+			}
+		}
+		if !found {
+			return nil
+		}
+
+		var us *UserMonthlySpending
+		for _, run := range runs {
+			if run.head == nil || run.head.key() != userKey {
+				continue
+			}
+			if us == nil {
+				us = cloneSpending(run.head)
+			} else {
+				us.merge(run.head)
+			}
+			if err := run.next(); err != nil {
+				return err
+			}
+		}
+		visit(us)
+	}
+}
+
+// close removes the spill files.
+func (a *aggregator) close() error {
+	var errs []error
+	for _, files := range a.spillFiles {
+		for _, path := range files {
+			errs = append(errs, os.Remove(path))
+		}
+	}
+	a.spillFiles = map[int][]string{}
+	return errors.Join(errs...)
+}
+
+// Aggregator accumulates card spending for long-running services, which
+// add transactions as they come and query the current ranking at any time
+// rather than once at the end of the input. It is safe for concurrent use.
+type Aggregator struct {
+	mu         sync.Mutex
+	processor  *processor
+	aggregates *aggregator
+}
+
+// NewAggregator returns an empty Aggregator. Options only affecting the
+// output written by TopSpenders are ignored.
+func NewAggregator(cfg Config) *Aggregator {
+	p := &processor{cfg: &cfg, aggregates: newAggregator(&cfg)}
+	return &Aggregator{processor: p, aggregates: p.aggregates}
+}
+
+// Add accounts tx like a row of the TopSpenders input. Transactions other
+// than card spending are ignored. Invalid transactions are returned as
+// errors, and so are input errors with StopOnError. tx can be reused once
+// Add returns.
+func (a *Aggregator) Add(tx *Transaction) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := tx.validate(a.processor.cfg); err != nil {
+		return err
+	}
+	return a.processor.process(parsedTx{tx: tx})
+}
+
+// TopN returns the n top spenders of the month, given as yyyymm, e.g.
+// 202401, ordered by total spend, then like the report's ranking. The
+// spendings are copies, so they stay unchanged by later transactions.
+func (a *Aggregator) TopN(monthKey, n int) ([]*UserMonthlySpending, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	month, err := rankedMonth(a.aggregates, monthKey, *a.processor.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	spendings := make([]*UserMonthlySpending, 0, len(month))
+	for _, us := range month {
+		spendings = append(spendings, cloneSpending(us))
+	}
+	sort.Slice(spendings, func(i, j int) bool {
+		if spendings[i].TotalGBP != spendings[j].TotalGBP {
+			return spendings[i].TotalGBP > spendings[j].TotalGBP
+		}
+		return tieBreak(spendings[i], spendings[j])
+	})
+	return spendings[:max(0, min(n, len(spendings)))], nil
+}
+
+// Close removes the spill files.
+func (a *Aggregator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.aggregates.close()
+}
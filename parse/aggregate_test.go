@@ -0,0 +1,210 @@
+package parse
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAggregator_spill(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 5, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 250, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 10, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 14, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,350.0000000,GBP,2,a@test.com,A,A
+2024/01,2,300.0000000,GBP,1,b@test.com,B,B
+2024/02,1,250.0000000,GBP,1,c@test.com,C,C
+2024/02,2,10.0000000,GBP,1,b@test.com,B,B
+`
+
+	t.Run("aggregates are spilled and merged", func(t *testing.T) {
+		cfg := Config{SpillDir: t.TempDir(), SpillLimit: 1}
+		aggregates := newAggregator(&cfg)
+		for _, tx := range transactions {
+			if err := aggregates.add(tx); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+
+		if len(aggregates.spillFiles) == 0 {
+			t.Fatal("expected aggregates to be spilled")
+		}
+		if aggregates.inMemory > cfg.SpillLimit {
+			t.Errorf("expected at most %d aggregates in memory, got %d", cfg.SpillLimit, aggregates.inMemory)
+		}
+
+		month, err := aggregates.month(202401)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if a := month["a@test.com"]; a.TotalGBP != DecimalFromFloat(350) || a.TransactionCount != 2 {
+			t.Errorf("expected merged spending of 350 over 2 transactions, got %v over %d", a.TotalGBP, a.TransactionCount)
+		}
+
+		if err := aggregates.close(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		entries, err := os.ReadDir(cfg.SpillDir)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(entries) > 0 {
+			t.Errorf("expected spill files to be removed, found %d", len(entries))
+		}
+	})
+
+	t.Run("ranking matches the in-memory path", func(t *testing.T) {
+		output, err := runTest(t, transactions, Config{SpillDir: t.TempDir(), SpillLimit: 1})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+
+	t.Run("external sort matches the in-memory path", func(t *testing.T) {
+		for _, cfg := range []Config{{}, {TopN: 1}, {TopN: 1, Order: OrderAsc}, {TopN: 1, CapMonthlySpend: 300}} {
+			inMemory, err := runTest(t, transactions, cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			cfg.ExternalSort, cfg.SpillLimit = true, 1
+			output, err := runTest(t, transactions, cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != inMemory {
+				t.Errorf("output csv does not match the in-memory output.\nGot:\n%s\nExpected:\n%s", output, inMemory)
+			}
+		}
+	})
+
+	t.Run("external sort keeps the top spenders of the month", func(t *testing.T) {
+		cfg := Config{ExternalSort: true, SpillDir: t.TempDir(), SpillLimit: 1, TopN: 1}
+		aggregates := newAggregator(&cfg)
+		defer aggregates.close()
+		for _, tx := range transactions {
+			if err := aggregates.add(tx); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+		}
+
+		month, err := topOfMonth(aggregates, 202401, cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(month) != 1 {
+			t.Fatalf("expected only the top spender to be kept, got %d", len(month))
+		}
+		if a := month["a@test.com"]; a == nil || a.TotalGBP != DecimalFromFloat(350) || a.TransactionCount != 2 {
+			t.Errorf("expected a's spending merged across the spill files, got %+v", a)
+		}
+	})
+}
+
+func TestAggregator_TopN(t *testing.T) {
+	t.Parallel()
+	date := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	spend := func(email string, amount float64) *Transaction {
+		return &Transaction{FirstName: "U", LastName: "U", Email: email, TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: date}
+	}
+	emails := func(spendings []*UserMonthlySpending) []string {
+		var emails []string
+		for _, us := range spendings {
+			emails = append(emails, us.Email)
+		}
+		return emails
+	}
+
+	aggregator := NewAggregator(Config{})
+	defer aggregator.Close()
+	for _, tx := range []*Transaction{spend("a@test.com", 100), spend("b@test.com", 300), spend("c@test.com", 200)} {
+		if err := aggregator.Add(tx); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	top, err := aggregator.TopN(202401, 2)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := emails(top); !slices.Equal(got, []string{"b@test.com", "c@test.com"}) {
+		t.Errorf("expected b and c ranked, got %v", got)
+	}
+
+	if err := aggregator.Add(spend("a@test.com", 350)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	updated, err := aggregator.TopN(202401, 2)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got := emails(updated); !slices.Equal(got, []string{"a@test.com", "b@test.com"}) {
+		t.Errorf("expected a and b ranked, got %v", got)
+	}
+	if updated[0].TotalGBP != DecimalFromFloat(450) {
+		t.Errorf("expected a to have spent 450, got %v", updated[0].TotalGBP)
+	}
+	if top[0].TotalGBP != DecimalFromFloat(300) || top[1].TotalGBP != DecimalFromFloat(200) {
+		t.Errorf("expected the earlier ranking to stay unchanged, got %v and %v", top[0].TotalGBP, top[1].TotalGBP)
+	}
+
+	t.Run("copies hold their own merchants and exact amounts", func(t *testing.T) {
+		aggregator := NewAggregator(Config{IncludeDistinctMerchants: true, ExactAmountStrings: true})
+		defer aggregator.Close()
+		tx := spend("a@test.com", 100)
+		tx.MerchantCode = "5013"
+		if err := aggregator.Add(tx); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		top, err := aggregator.TopN(202401, 1)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		tx = spend("a@test.com", 50)
+		tx.MerchantCode = "5411"
+		if err := aggregator.Add(tx); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(top[0].merchants) != 1 {
+			t.Errorf("expected the copy to keep 1 merchant, got %d", len(top[0].merchants))
+		}
+		if top[0].exactGBP.Cmp(exactRat(100)) != 0 {
+			t.Errorf("expected the copy to keep an exact amount of 100, got %v", top[0].exactGBP)
+		}
+	})
+}
+
+func TestAggregator_Add(t *testing.T) {
+	t.Parallel()
+	t.Run("email aliases leave the transaction unchanged", func(t *testing.T) {
+		aggregator := NewAggregator(Config{EmailAliases: map[string]string{"alias@test.com": "a@test.com"}})
+		defer aggregator.Close()
+		tx := &Transaction{FirstName: "A", LastName: "A", Email: "alias@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)}
+		if err := aggregator.Add(tx); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if tx.Email != "alias@test.com" {
+			t.Errorf("expected the transaction email to stay alias@test.com, got %s", tx.Email)
+		}
+		top, err := aggregator.TopN(202401, 1)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(top) != 1 || top[0].Email != "a@test.com" {
+			t.Errorf("expected the spending accounted under a@test.com, got %+v", top)
+		}
+	})
+}
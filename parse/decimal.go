@@ -0,0 +1,37 @@
+package parse
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Decimal is a fixed-point amount counted in units of 10^-7, the precision
+// amounts are written with. Sums of decimals are exact, where summing many
+// float64 amounts drifts by fractions of a penny.
+type Decimal int64
+
+// decimalScale is the number of Decimal units per whole amount.
+const decimalScale = 10_000_000
+
+// DecimalFromFloat returns f rounded to the nearest Decimal unit.
+func DecimalFromFloat(f float64) Decimal {
+	return Decimal(math.Round(f * decimalScale))
+}
+
+// Float64 returns d as a float64, e.g. for computing averages.
+func (d Decimal) Float64() float64 {
+	return float64(d) / decimalScale
+}
+
+// String formats d with all its 7 decimals, e.g. 2500.0000000.
+func (d Decimal) String() string {
+	sign := ""
+	units := int64(d)
+	if units < 0 {
+		sign, units = "-", -units
+	}
+	whole, frac := units/decimalScale, units%decimalScale
+	fracDigits := strconv.FormatInt(frac, 10)
+	return sign + strconv.FormatInt(whole, 10) + "." + strings.Repeat("0", currencyPrecisionDecimals-len(fracDigits)) + fracDigits
+}
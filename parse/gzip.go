@@ -0,0 +1,46 @@
+package parse
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Decompress returns r decompressed when it holds a gzip stream, telling by
+// its first bytes, and returns r's content as is otherwise. Errors reading a
+// corrupt stream start with "invalid gzip input".
+func Decompress(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return buffered, nil
+	}
+
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip input: %w", err)
+	}
+	return gzipReader{gz}, nil
+}
+
+// gzipReader tells the errors of a corrupt gzip stream apart from those of
+// the CSV within.
+type gzipReader struct {
+	*gzip.Reader
+}
+
+func (r gzipReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("invalid gzip input: %w", err)
+	}
+	return n, err
+}
@@ -0,0 +1,182 @@
+package parse
+
+import (
+	"encoding/json"
+	"io"
+	"math/big"
+)
+
+// Row is a ranked report row as written in the JSON output formats. Its
+// fields mirror the CSV columns; optional ones are omitted unless enabled.
+type Row struct {
+	Date string `json:"date"`
+	Rank int    `json:"rank,omitempty"`
+	// Label replaces the rank of synthetic rows, e.g. "(others)".
+	Label string `json:"label,omitempty"`
+	// Amount keeps the decimals of the CSV amount, exact with
+	// Config.ExactAmountStrings. Amount.Float64 reads it as a number.
+	Amount       json.Number `json:"amount"`
+	Currency     string      `json:"currency"`
+	Transactions int         `json:"transactions"`
+	Email        string      `json:"email"`
+	FirstName    string      `json:"firstName"`
+	LastName     string      `json:"lastName"`
+
+	MovingAvgGBP      *float64  `json:"movingAvgGBP,omitempty"`
+	GrowthGBP         *float64  `json:"growthGBP,omitempty"`
+	Segment           string    `json:"segment,omitempty"`
+	Category          string    `json:"category,omitempty"`
+	DistinctMerchants *int      `json:"distinctMerchants,omitempty"`
+	CountPercentile   *float64  `json:"countPercentile,omitempty"`
+	CountRank         *int      `json:"countRank,omitempty"`
+	GrossGBP          *float64  `json:"grossGBP,omitempty"`
+	Refunds           *int      `json:"refunds,omitempty"`
+	Sparkline         []float64 `json:"sparkline,omitempty"`
+}
+
+func newRow(r *reportRow, cfg Config) Row {
+	row := Row{
+		Date:         cfg.periodLabel(r.month),
+		Label:        r.label,
+		Currency:     r.currency,
+		Transactions: r.spending.TransactionCount,
+		Email:        r.spending.Email,
+		FirstName:    r.spending.FirstName,
+		LastName:     r.spending.LastName,
+		Category:     r.spending.Category,
+		Sparkline:    r.sparkline,
+	}
+	if r.label == "" {
+		row.Rank = r.rank
+	}
+	switch {
+	case cfg.ExactAmountStrings:
+		amount := new(big.Rat)
+		if r.spending.exactGBP != nil {
+			amount.Mul(r.spending.exactGBP, exactRat(r.rate))
+		}
+		row.Amount = json.Number(formatExact(amount))
+	case r.rate != 1:
+		row.Amount = json.Number(formatAmount(r.spending.TotalGBP.Float64() * r.rate))
+	default:
+		row.Amount = json.Number(r.spending.TotalGBP.String())
+	}
+	if cfg.MovingAverageMonths > 0 {
+		row.MovingAvgGBP = &r.movingAvgGBP
+	}
+	if cfg.ReportType == TopGrowth {
+		row.GrowthGBP = &r.score
+	}
+	if cfg.IncludeBottomN > 0 {
+		row.Segment = "top"
+		if r.bottom {
+			row.Segment = "bottom"
+		}
+	}
+	if cfg.IncludeDistinctMerchants {
+		merchants := len(r.spending.merchants)
+		row.DistinctMerchants = &merchants
+	}
+	if cfg.IncludeCountPercentile {
+		row.CountPercentile = &r.countPercentile
+	}
+	if cfg.IncludeCountRank {
+		row.CountRank = &r.countRank
+	}
+	if cfg.CountRefundsSeparately {
+		gross := r.spending.GrossGBP().Float64()
+		row.GrossGBP = &gross
+		row.Refunds = &r.spending.RefundCount
+	}
+	return row
+}
+
+// writeJSON writes the rankings as a single JSON array, in the order of the
+// CSV rows.
+func writeJSON(rankings []*monthRanking, w io.Writer, cfg Config) error {
+	rows := []Row{}
+	for _, ranking := range rankings {
+		for _, r := range ranking.rows {
+			rows = append(rows, newRow(r, cfg))
+		}
+	}
+	return writeJSONLine(w, rows, cfg)
+}
+
+// writeJSONNested writes the rankings as a single JSON object keyed by month.
+func writeJSONNested(rankings []*monthRanking, w io.Writer, cfg Config) error {
+	months := make(map[string][]Row, len(rankings))
+	for _, ranking := range rankings {
+		rows := make([]Row, 0, len(ranking.rows))
+		for _, r := range ranking.rows {
+			rows = append(rows, newRow(r, cfg))
+		}
+		months[cfg.periodLabel(ranking.month)] = rows
+	}
+	return writeJSONLine(w, months, cfg)
+}
+
+// writeJSONLine writes v as a line of JSON, ended like the other output
+// lines.
+func writeJSONLine(w io.Writer, v any, cfg Config) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, string(line)+cfg.lineEnd())
+	return err
+}
+
+// MonthSummary is a month of the month-summary-jsonl output format. Amounts
+// are in GBP.
+type MonthSummary struct {
+	Month string `json:"month"`
+	// TopSpenderEmail and TopAmount describe the first ranked row.
+	TopSpenderEmail string  `json:"topSpenderEmail"`
+	TopAmount       float64 `json:"topAmount"`
+	// TotalSpenders and MonthTotal cover every spender of the month,
+	// ranked or not.
+	TotalSpenders int     `json:"totalSpenders"`
+	MonthTotal    float64 `json:"monthTotal"`
+}
+
+// writeMonthSummaries writes a MonthSummary line per ranked month.
+func writeMonthSummaries(aggregates *aggregator, rankings []*monthRanking, w io.Writer, cfg Config) error {
+	for _, ranking := range rankings {
+		month, err := aggregates.month(ranking.month)
+		if err != nil {
+			return err
+		}
+
+		summary := MonthSummary{
+			Month:         cfg.periodLabel(ranking.month),
+			TotalSpenders: len(month),
+		}
+		var total Decimal
+		for _, us := range month {
+			total += us.TotalGBP
+		}
+		summary.MonthTotal = total.Float64()
+		if len(ranking.rows) > 0 {
+			top := ranking.rows[0].spending
+			summary.TopSpenderEmail = top.Email
+			summary.TopAmount = top.TotalGBP.Float64()
+		}
+
+		if err := writeJSONLine(w, summary, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SkippedRow is a line of Config.ErrorWriter, describing an input row that
+// was skipped.
+type SkippedRow struct {
+	// Line is the 1-based input line the row starts on, when known.
+	Line   int      `json:"line,omitempty"`
+	Record []string `json:"record"`
+	Error  string   `json:"error"`
+	// Source names the input of the row with TopSpendersMulti.
+	Source string `json:"source,omitempty"`
+}
@@ -0,0 +1,88 @@
+package parse
+
+import "fmt"
+
+// liveRanking keeps the users of a month ranked by total spend while the
+// input is aggregated, for Config.OnRankChange.
+type liveRanking struct {
+	month  int
+	totals map[string]float64
+	// order holds the emails by total descending, and index the position of
+	// every email in order.
+	order []string
+	index map[string]int
+}
+
+func newLiveRanking(month int) *liveRanking {
+	return &liveRanking{month: month, totals: map[string]float64{}, index: map[string]int{}}
+}
+
+// rankChange is the move of a user from oldRank to newRank, 1-based.
+type rankChange struct {
+	email            string
+	oldRank, newRank int
+}
+
+// add accounts amount to the user's total and returns the rank changes it
+// causes, the user's own first.
+func (l *liveRanking) add(email string, amount float64) []rankChange {
+	i, seen := l.index[email]
+	if !seen {
+		l.order = append(l.order, email)
+		i = len(l.order) - 1
+	}
+	l.totals[email] += amount
+
+	// Move the user to its new position, shifting the users in between by one.
+	from := i
+	for i > 0 && l.totals[l.order[i-1]] < l.totals[email] {
+		l.order[i] = l.order[i-1]
+		l.index[l.order[i]] = i
+		i--
+	}
+	for i < len(l.order)-1 && l.totals[l.order[i+1]] > l.totals[email] {
+		l.order[i] = l.order[i+1]
+		l.index[l.order[i]] = i
+		i++
+	}
+	l.order[i] = email
+	l.index[email] = i
+
+	var changes []rankChange
+	if !seen {
+		changes = append(changes, rankChange{email: email, oldRank: 0, newRank: i + 1})
+	} else if i != from {
+		changes = append(changes, rankChange{email: email, oldRank: from + 1, newRank: i + 1})
+	}
+	// The users in between moved by one in the opposite direction.
+	switch {
+	case i < from:
+		for j := i + 1; j <= from; j++ {
+			changes = append(changes, rankChange{email: l.order[j], oldRank: j, newRank: j + 1})
+		}
+	case i > from:
+		for j := from; j < i; j++ {
+			changes = append(changes, rankChange{email: l.order[j], oldRank: j + 2, newRank: j + 1})
+		}
+	}
+	return changes
+}
+
+// trackRank updates the live ranking of the month of tx, reporting the
+// changes to Config.OnRankChange. It fails on a transaction of an earlier
+// month than the ranked one, as the ranks reported would be wrong.
+func (p *processor) trackRank(tx *Transaction) error {
+	key := p.cfg.periodKey(tx.Date)
+	if p.live != nil && key < p.live.month {
+		return fmt.Errorf("input not sorted by date: %s after %s", p.cfg.periodLabel(key), p.cfg.periodLabel(p.live.month))
+	}
+	if p.live == nil || p.live.month != key {
+		p.live = newLiveRanking(key)
+	}
+
+	gbp, _ := gbpValue(tx, p.cfg)
+	for _, c := range p.live.add(tx.Email, gbp) {
+		p.cfg.OnRankChange(key, c.email, c.oldRank, c.newRank)
+	}
+	return nil
+}
@@ -1,14 +1,27 @@
 package parse
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"math/big"
+	"math/bits"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -17,6 +30,7 @@ const (
 	txCardSpend = "CARD SPEND"
 	txBuyGold   = "BUY GOLD"
 	txSellGold  = "SELL GOLD"
+	txRefund    = "REFUND"
 
 	currencyGBP = "GBP"
 	currencyGGM = "GGM"
@@ -24,6 +38,9 @@ const (
 	currencyPrecisionDecimals = 7
 )
 
+// inputHeader holds the names of the input columns, in order.
+var inputHeader = []string{"First name", "Last name", "Email", "Description", "Merchant code", "Amount", "From Currency", "To Currency", "Rate", "Date"}
+
 type Transaction struct {
 	FirstName       string
 	LastName        string
@@ -35,155 +52,2475 @@ type Transaction struct {
 	ToCurrency      string
 	Rate            float64
 	Date            time.Time
+	// ID is the unique id of the transaction, read with Config.DedupeByID.
+	ID string
+}
+
+// knownType reports whether txType is one of the transaction types of the
+// input.
+func knownType(txType string) bool {
+	switch txType {
+	case txBuyGold, txSellGold, txCardSpend, txRefund:
+		return true
+	}
+	return false
+}
+
+func (t *Transaction) validate(cfg *Config) error {
+	if !knownType(t.TransactionType) {
+		return fmt.Errorf("unknown transaction type: %s", t.TransactionType)
+	}
+
+	// The rate is the gold gram price in GBP, so gold can only be converted
+	// from or to GBP. There is no conversion path to any other currency.
+	if t.FromCurrency == currencyGGM && t.ToCurrency != currencyGBP && t.ToCurrency != currencyGGM {
+		return fmt.Errorf("cannot convert %s to %s: gold is only priced in %s", t.FromCurrency, t.ToCurrency, currencyGBP)
+	}
+
+	switch t.FromCurrency {
+	case currencyGBP, currencyGGM:
+	default:
+		return fmt.Errorf("unsupported currency: %s", t.FromCurrency)
+	}
+
+	switch t.ToCurrency {
+	case currencyGBP, currencyGGM:
+	default:
+		return fmt.Errorf("unsupported currency: %s", t.ToCurrency)
+	}
+
+	if cfg.RequireNames && (t.FirstName == "" || t.LastName == "") {
+		return fmt.Errorf("missing first or last name")
+	}
+
+	if t.Date.Before(cfg.MinDate) {
+		layout := cfg.dateLayouts()[0]
+		return fmt.Errorf("date %s is before %s", t.Date.Format(layout), cfg.MinDate.Format(layout))
+	}
+
+	// GGM amounts are converted to GBP using the rate. This includes GGM to
+	// GGM rows: the rate is the gram price rather than the rate between the
+	// two sides, so the grams spent are valued like any other gold.
+	if t.FromCurrency == currencyGGM && cfg.rate(t) <= 0 {
+		return fmt.Errorf("missing or invalid rate for %s: %v", currencyGGM, t.Rate)
+	}
+
+	return nil
+}
+
+// nameContains reports whether the user's name or email contains substr,
+// ignoring case.
+func (t *Transaction) nameContains(substr string) bool {
+	substr = strings.ToLower(substr)
+	for _, field := range []string{t.FirstName, t.LastName, t.Email} {
+		if strings.Contains(strings.ToLower(field), substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// txPool recycles transactions when Config.ReuseTransactions is set.
+var txPool = sync.Pool{
+	New: func() any { return new(Transaction) },
+}
+
+type UserMonthlySpending struct {
+	FirstName        string
+	LastName         string
+	Email            string
+	TotalGBP         Decimal
+	TransactionCount int
+	// Category is the merchant category when aggregating by category.
+	Category string
+	// RefundGBP and RefundCount account the rows with a negative amount
+	// when Config.CountRefundsSeparately is set. TotalGBP is net of them.
+	RefundGBP   Decimal
+	RefundCount int
+
+	// exactGBP mirrors TotalGBP without float rounding when
+	// Config.ExactAmountStrings is set.
+	exactGBP *big.Rat
+	// merchants holds the merchant codes seen when
+	// Config.IncludeDistinctMerchants is set.
+	merchants map[string]bool
+	// weightedGBP is the spend weighted by recency when
+	// Config.RecencyWeighting is set.
+	weightedGBP float64
+	// activeDays has bit d-1 set for every day d of the month with spend
+	// when Config.MinActiveDays is set.
+	activeDays uint32
+}
+
+// amountGBP returns the amount of tx as written in the input, converted to
+// GBP.
+func amountGBP(tx *Transaction, cfg *Config) float64 {
+	if tx.FromCurrency == currencyGGM {
+		return tx.Amount * cfg.rate(tx)
+	}
+	return tx.Amount
+}
+
+// rankedAmount returns the amount of tx in the currency it is ranked in:
+// GBP, or its own currency with Config.RankPerCurrency.
+func rankedAmount(tx *Transaction, cfg *Config) float64 {
+	if cfg.RankPerCurrency {
+		return tx.Amount
+	}
+	return amountGBP(tx, cfg)
+}
+
+// gbpValue returns what tx adds to the spending of its user in GBP, or in
+// its own currency with Config.RankPerCurrency, and whether it was capped at
+// Config.WinsorizeTxGBP.
+func gbpValue(tx *Transaction, cfg *Config) (gbp float64, capped bool) {
+	// We track spending in GBP: marketing purposes.
+	// Gold is valued at the gram price, whatever it was converted to.
+	gbp = rankedAmount(tx, cfg)
+	capped = cfg.WinsorizeTxGBP > 0 && gbp > cfg.WinsorizeTxGBP
+	if capped {
+		gbp = cfg.WinsorizeTxGBP
+	}
+	if tx.TransactionType == txRefund {
+		gbp = -math.Abs(gbp)
+	}
+	return gbp, capped
+}
+
+func (us *UserMonthlySpending) update(tx *Transaction, cfg *Config) {
+	us.display(tx.Email, tx.FirstName, tx.LastName)
+	gbp, capped := gbpValue(tx, cfg)
+	refund := tx.TransactionType == txRefund
+	us.TotalGBP += DecimalFromFloat(gbp)
+
+	if cfg.RecencyWeighting {
+		us.weightedGBP += gbp * recencyWeight(tx.Date)
+	}
+
+	if cfg.ExactAmountStrings {
+		if us.exactGBP == nil {
+			us.exactGBP = new(big.Rat)
+		}
+		amount := exactRat(tx.Amount)
+		if tx.FromCurrency == currencyGGM && !cfg.RankPerCurrency {
+			amount.Mul(amount, exactRat(cfg.rate(tx)))
+		}
+		if capped {
+			amount = exactRat(cfg.WinsorizeTxGBP)
+		}
+		if refund {
+			amount.Neg(amount.Abs(amount))
+		}
+		us.exactGBP.Add(us.exactGBP, amount)
+	}
+
+	if cfg.IncludeDistinctMerchants {
+		if us.merchants == nil {
+			us.merchants = map[string]bool{}
+		}
+		us.merchants[tx.MerchantCode] = true
+	}
+
+	if cfg.MinActiveDays > 0 && !refund {
+		us.activeDays |= 1 << (tx.Date.Day() - 1)
+	}
+
+	if cfg.CountRefundsSeparately && gbp < 0 {
+		us.RefundGBP -= DecimalFromFloat(gbp)
+		us.RefundCount++
+		return
+	}
+	us.TransactionCount++
+}
+
+// GrossGBP returns the spend before the refunds counted separately.
+func (us *UserMonthlySpending) GrossGBP() Decimal {
+	return us.TotalGBP + us.RefundGBP
+}
+
+// recencyHalfLifeDays is the number of days before the end of the month over
+// which the weight of a transaction halves when Config.RecencyWeighting is set.
+const recencyHalfLifeDays = 7
+
+// recencyWeight weighs a transaction by how late in its month it happened,
+// from 1 at the very end of the month decaying exponentially towards its start.
+func recencyWeight(date time.Time) float64 {
+	monthEnd := time.Date(date.Year(), date.Month()+1, 1, 0, 0, 0, 0, date.Location())
+	daysLeft := monthEnd.Sub(date).Hours() / 24
+	return math.Pow(0.5, daysLeft/recencyHalfLifeDays)
+}
+
+// key identifies the spending within its month.
+func (us *UserMonthlySpending) key() string {
+	return spendingKey(us.Category, us.Email)
+}
+
+func spendingKey(category, email string) string {
+	if category == "" {
+		return email
+	}
+	return category + ":" + email
+}
+
+// display keeps the smallest of the emails and names the user was seen with,
+// so that what is shown doesn't depend on the order of the input.
+func (us *UserMonthlySpending) display(email, firstName, lastName string) {
+	if cmp.Or(
+		strings.Compare(email, us.Email),
+		strings.Compare(firstName, us.FirstName),
+		strings.Compare(lastName, us.LastName),
+	) < 0 {
+		us.Email, us.FirstName, us.LastName = email, firstName, lastName
+	}
+}
+
+// merge adds the spending accumulated in other to us.
+func (us *UserMonthlySpending) merge(other *UserMonthlySpending) {
+	us.display(other.Email, other.FirstName, other.LastName)
+	us.TotalGBP += other.TotalGBP
+	us.TransactionCount += other.TransactionCount
+	us.weightedGBP += other.weightedGBP
+	us.activeDays |= other.activeDays
+	us.RefundGBP += other.RefundGBP
+	us.RefundCount += other.RefundCount
+
+	if other.exactGBP != nil {
+		if us.exactGBP == nil {
+			us.exactGBP = new(big.Rat)
+		}
+		us.exactGBP.Add(us.exactGBP, other.exactGBP)
+	}
+
+	if other.merchants != nil {
+		if us.merchants == nil {
+			us.merchants = map[string]bool{}
+		}
+		for code := range other.merchants {
+			us.merchants[code] = true
+		}
+	}
+}
+
+// exactRat returns the decimal value of f as written in the input, i.e. the
+// shortest decimal that parses back to f rather than its binary expansion.
+func exactRat(f float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return r
+}
+
+// formatExact formats r as a decimal string with as many digits as needed
+// to represent it exactly, e.g. 1 -> 1.0, 0.125 -> 0.125.
+func formatExact(r *big.Rat) string {
+	if r == nil {
+		return "0.0"
+	}
+
+	// A fraction in lowest terms has a finite decimal expansion when its
+	// denominator only has the prime factors 2 and 5.
+	denom := new(big.Int).Set(r.Denom())
+	two, five := big.NewInt(2), big.NewInt(5)
+	twos, fives := 0, 0
+	for new(big.Int).Rem(denom, two).Sign() == 0 {
+		denom.Quo(denom, two)
+		twos++
+	}
+	for new(big.Int).Rem(denom, five).Sign() == 0 {
+		denom.Quo(denom, five)
+		fives++
+	}
+	if denom.Cmp(big.NewInt(1)) != 0 {
+		return r.FloatString(currencyPrecisionDecimals)
+	}
+
+	prec := max(twos, fives, 1)
+	return r.FloatString(prec)
+}
+
+type Config struct {
+	StopOnError bool
+
+	// MovingAverageMonths adds a movingAvgGBP column holding the trailing
+	// average of the user's spend over this many calendar months, ending
+	// with the reported month. Zero disables the column.
+	MovingAverageMonths int
+	// MovingAverageSkipGaps leaves months without spend out of the average
+	// instead of counting them as zero.
+	MovingAverageSkipGaps bool
+
+	// SkipFirstRows skips this many data rows after the header, e.g. to
+	// resume an interrupted run from a recorded row.
+	SkipFirstRows int
+
+	// OnlyConsistentSpenders restricts the report to users who are ranked
+	// in every month present in the input. Their original ranks are kept.
+	OnlyConsistentSpenders bool
+
+	// OutputChurn replaces the ranking with a report of the users entering
+	// and leaving the top spenders compared to the previous month in the input.
+	OutputChurn bool
+
+	// ExactAmountStrings accumulates amounts as exact decimals and writes
+	// them without float rounding, using as many digits as the value needs.
+	ExactAmountStrings bool
+
+	// EmptyResultBehavior controls the output when no spending is ranked.
+	EmptyResultBehavior EmptyResultBehavior
+
+	// RejectsWriter, when set, receives every skipped input row as CSV:
+	// the original fields followed by the error, and by the name of the
+	// source with TopSpendersMulti.
+	RejectsWriter io.Writer
+
+	// ErrorWriter, when set, receives every skipped input row as a
+	// SkippedRow JSON line instead of it being logged.
+	ErrorWriter io.Writer
+
+	// SpillDir enables disk-backed aggregation for inputs whose aggregates
+	// don't fit in memory. Partial aggregates are spilled to temp files in
+	// this directory, which are removed before returning.
+	SpillDir string
+	// SpillLimit is the number of user-month aggregates held in memory
+	// before spilling. Defaults to 1,000,000 when spilling.
+	SpillLimit int
+	// ExternalSort enables the disk-backed aggregation of SpillDir, in the
+	// default temp directory unless SpillDir is set, and ranks every month by
+	// merging its spill files as sorted streams, holding only the top N
+	// spenders of the month in memory. The options needing every spender of
+	// a month, like TopPercentile, IncludeBottomN, IncludeOthersRow,
+	// IncludePercentiles, IncludeMonthlyTotals, the count ranks, the tied
+	// group policies, TopGrowth, RecencyWeighting, moving averages,
+	// sparklines, and the month summary, matrix, churn and histogram
+	// outputs, still merge the month in memory.
+	ExternalSort bool
+
+	// DateLayouts lists the accepted date layouts, tried in order. The first
+	// layout is used wherever dates are formatted. Defaults to timeLayout.
+	DateLayouts []string
+
+	// IncludeSparkline adds a sparkline column with the user's spend in each
+	// of the trailing 12 months, oldest first, as a comma-separated series.
+	IncludeSparkline bool
+
+	// UserCurrencyPreference returns the currency a user's amounts are
+	// displayed in. Aggregation is always done in GBP; the total is converted
+	// with DisplayRates when written. An empty result means GBP.
+	UserCurrencyPreference func(email string) string
+	// DisplayRates holds the units of each display currency per one GBP.
+	DisplayRates map[string]float64
+	// RequireConvertible treats transactions that can't be converted to the
+	// user's display currency as input errors, following StopOnError.
+	RequireConvertible bool
+
+	// RequireNames rejects transactions with an empty first or last name.
+	// Names are trimmed of surrounding whitespace regardless.
+	RequireNames bool
+
+	// SkipZeroAmount ignores zero-amount spend transactions, such as card
+	// authorizations, so they don't count towards the transaction count.
+	SkipZeroAmount bool
+
+	// Logger receives the input errors skipped when StopOnError is unset.
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// Aggregation selects how spending is grouped within a month.
+	// Defaults to ranking users across all merchants.
+	Aggregation string
+	// MerchantCategories maps merchant codes to categories for
+	// AggregationByCategory. Unmapped codes fall into categoryOther.
+	MerchantCategories map[string]string
+
+	// IncludeBottomN appends this many of the lowest spenders after the top
+	// spenders of each month, marked in a segment column. Users already
+	// ranked at the top are never repeated.
+	IncludeBottomN int
+
+	// LocaleFormat writes amounts with thousands separators and two decimals,
+	// e.g. "2,500.00". The field is quoted, and no longer parses as a number.
+	LocaleFormat bool
+
+	// ReportType selects what users are ranked by.
+	ReportType ReportType
+
+	// CRLF terminates output lines with \r\n instead of \n, in the CSV and
+	// JSON output formats and in the lines of RejectsWriter and ErrorWriter.
+	CRLF bool
+
+	// NameContains restricts the report to users whose first name, last name
+	// or email contains it, ignoring case.
+	NameContains string
+
+	// SnapshotEvery writes the report of the rows processed so far to
+	// SnapshotWriter after every this many input rows. Snapshots are
+	// best-effort: failures are logged and don't stop processing.
+	SnapshotEvery  int
+	SnapshotWriter io.Writer
+
+	// ReuseTransactions recycles the decoded transactions once they have
+	// been aggregated to reduce allocations. Only safe where transactions
+	// aren't handed to callers.
+	ReuseTransactions bool
+
+	// ExpectOnlySpend treats any transaction of a type not counted as an
+	// input error instead of ignoring it.
+	ExpectOnlySpend bool
+
+	// TruncatePolicy decides where the ranking is cut when users tied on
+	// their spend straddle the last ranked position.
+	TruncatePolicy TruncatePolicy
+
+	// IncludeOthersRow adds a row after the ranked users of each month,
+	// summing the spend and transactions of everyone not listed.
+	IncludeOthersRow bool
+
+	// IncludeMonthlyTotals adds a TOTAL row at the end of each month,
+	// summing the spend and transactions of every user of the month,
+	// ranked or not.
+	IncludeMonthlyTotals bool
+
+	// IncludeMonthTotal adds a "ranked total" row after the ranked users of
+	// each month, summing the spend and transactions of the users listed,
+	// unlike the TOTAL row of IncludeMonthlyTotals. Months without ranked
+	// users get none.
+	IncludeMonthTotal bool
+
+	// RateVarianceThreshold logs a warning for every month where the ratio
+	// of the highest to the lowest rate of a currency pair exceeds it,
+	// e.g. 1.1 for rates varying by more than 10%. Zero disables the check.
+	RateVarianceThreshold float64
+
+	// IncludeDistinctMerchants adds the number of distinct merchants each
+	// user spent at. It keeps a set of merchant codes per user and month,
+	// so memory grows with the number of merchants rather than staying
+	// constant per user.
+	IncludeDistinctMerchants bool
+
+	// IntegerAmountsOnly rejects the rows whose amount or rate isn't a plain
+	// integer, e.g. 100.50 or 1e2, for inputs where amounts are always whole
+	// minor units.
+	IntegerAmountsOnly bool
+
+	// HeaderSource, when set, supplies the header row, and the input is
+	// read as data rows from its first line, for headerless data files
+	// with a separately maintained header.
+	HeaderSource io.Reader
+
+	// HumanAmounts writes amounts for people rather than machines, with the
+	// symbol of the reporting currency, thousands separators and two
+	// decimals, e.g. "£2,500.00". It takes precedence over LocaleFormat.
+	HumanAmounts bool
+
+	// OutputColumns selects the report columns and their order by name,
+	// e.g. email,date,amount. Optional columns can only be selected when
+	// enabled. Defaults to every column.
+	OutputColumns []string
+
+	// TimeBudget stops reading the input once it elapses and writes the
+	// report of the rows read so far. Such a report is partial: the last
+	// date read is logged, and with input sorted by date only the months
+	// before that date's month are complete. Zero means no limit.
+	TimeBudget time.Duration
+
+	// DailyRates overrides the rate of the input rows with the authoritative
+	// rate of the transaction's day, keyed by date as 2006-01-02 and then by
+	// the currency converted to GBP, e.g. DailyRates["2024-01-10"]["GGM"].
+	// Rows without a daily rate keep their own rate, or the one of Rates when
+	// empty or zero.
+	DailyRates map[string]map[string]float64
+	// RequireDailyRate rejects the rows without a daily rate instead.
+	RequireDailyRate bool
+
+	// Rates holds the reference rates of the rows with a zero or empty
+	// rate, keyed by currency pair, e.g. Rates["GGM:GBP"] for the gold
+	// gram price in GBP. The rate of a row takes precedence.
+	Rates map[string]float64
+
+	// RecencyWeighting ranks users by their spend weighted by how late in
+	// the month it happened, halving every 7 days before the month's end.
+	// The amount column still holds the true total.
+	RecencyWeighting bool
+
+	// OutputFormat selects how the report is written. Defaults to CSV, which
+	// can also be selected as "csv".
+	// OutputColumns only applies to CSV.
+	OutputFormat string
+
+	// WinsorizeTxGBP caps the contribution of any single transaction to
+	// this many GBP, so that outliers don't dominate the ranking. The
+	// reported amounts are then adjusted totals rather than the true spend;
+	// transaction counts are unaffected. Zero disables the cap.
+	WinsorizeTxGBP float64
+
+	// SlowThreshold logs a warning when reading and aggregating the input
+	// takes longer than it. Zero disables the warning.
+	SlowThreshold time.Duration
+
+	// OutputTargets receive the report in addition to the results writer,
+	// from the same aggregation, each with its own filter and format.
+	OutputTargets []OutputTarget
+
+	// DefaultCurrency replaces empty from and to currencies of the input,
+	// e.g. GBP. By default rows without a currency are rejected.
+	DefaultCurrency string
+
+	// MatrixZeroFill writes zero rather than leaving the cell empty for the
+	// months a user didn't spend in, in the matrix output format.
+	MatrixZeroFill bool
+
+	// CapMonthlySpend caps every user's monthly total at this many GBP
+	// before ranking, to dampen the influence of the largest spenders. The
+	// amount column shows the capped total, and growth is computed between
+	// capped totals. Zero disables the cap.
+	CapMonthlySpend float64
+
+	// RefundsReduceSpend subtracts REFUND transactions from the monthly
+	// total of their user, and counts them as transactions. Totals can then
+	// go negative, ranking such users last. Filters on the amount of a row,
+	// like SkipZeroAmount, see the refunded amount as written in the input.
+	// REFUND rows are ignored otherwise.
+	RefundsReduceSpend bool
+
+	// CountRefundsSeparately counts the rows with a negative amount, like
+	// the REFUND rows of RefundsReduceSpend, as refunds rather than as
+	// transactions, and adds the grossGBP and refunds columns. Users are
+	// still ranked, and tied, on their net spend, the amount column.
+	CountRefundsSeparately bool
+
+	// OnRankChange is called while aggregating whenever the provisional rank
+	// of a user within the month of the transaction changes, for every user
+	// affected. Users enter with oldRank 0. Ranks are over all the users of
+	// the month by total spend, regardless of Aggregation, and start over
+	// with every month, so the input must be sorted by date: a transaction of
+	// an earlier month than the one before it fails with an error. The month
+	// is given as yyyymm, e.g. 202401.
+	OnRankChange func(month int, email string, oldRank, newRank int)
+
+	// SeparateDateTime reads the date and the time of the transactions from
+	// two columns, DateColumn and TimeColumn, 0-based and defaulting to 9 and
+	// 10. They are joined with a space and parsed with DateLayouts.
+	SeparateDateTime bool
+	DateColumn       int
+	TimeColumn       int
+
+	// Histogram replaces the ranking with a histogram of the total spend of
+	// all users in every month: the number of users per bucket of
+	// HistogramBucketGBP, 100 by default, from inclusive to exclusive.
+	Histogram          bool
+	HistogramBucketGBP float64
+
+	// IncludeCountPercentile adds the percentage of the users of the month
+	// with at most as many transactions as the ranked user. Users with the
+	// same number of transactions share a percentile.
+	IncludeCountPercentile bool
+
+	// PadToTopN fills the ranking of months with fewer spenders than ranked
+	// with placeholder rows, holding a rank, no user and a zero amount, so
+	// every month has the same number of rows.
+	PadToTopN bool
+
+	// IncludePercentiles appends a row per percentile to every month, e.g.
+	// 0.5 for the median, holding that percentile of the total spend of all
+	// the users of the month in GBP. The rows are labelled like p50.
+	IncludePercentiles []float64
+
+	// IncludeSchemaComment writes a comment line before the CSV header
+	// describing the type of every column written, like
+	// "# date:string, rank:int, amount:float". Types are string, int and
+	// float.
+	IncludeSchemaComment bool
+
+	// LogLevel is the lowest level logged, e.g. slog.LevelError to silence
+	// the warnings. It can only make the Logger quieter than its handler.
+	// Defaults to slog.LevelInfo.
+	LogLevel slog.Level
+
+	// TopPercentile ranks the top fraction of the users of every month by
+	// spend, e.g. 0.05 for the top 5%, instead of the top TopN users. The
+	// number of users ranked is rounded up, so at least one is ranked.
+	TopPercentile float64
+
+	// OnMonthComplete is called with the ranked users of every month of
+	// the report once the input is read, earliest first, before the report
+	// is written. The month is given as yyyymm, e.g. 202401.
+	// Snapshots don't call it.
+	OnMonthComplete func(month int, ranked []*UserMonthlySpending)
+
+	// MinDate rejects the transactions dated before it as invalid rows,
+	// e.g. to catch corrupt dates like 01/01/1970.
+	MinDate time.Time
+
+	// QuoteAllFields quotes every field of the CSV written, including the
+	// header and the rejected rows, for strict parsers. By default fields
+	// are only quoted where needed.
+	QuoteAllFields bool
+
+	// RankPerCurrency ranks the spenders of every currency separately, by
+	// their total in that currency rather than in GBP, e.g. GGM spenders by
+	// grams spent. Every month has a block of rows per currency, ordered by
+	// currency. It replaces the grouping of Aggregation, and the amount
+	// options given in GBP, like WinsorizeTxGBP, apply to the native amounts.
+	RankPerCurrency bool
+
+	// DedupeByID skips the rows repeating the transaction id of an earlier
+	// row, across all the input. The id is read from the column named
+	// IDHeader in the header row, or else from IDColumn, 0-based, which has
+	// to be set as zero is the first name column. Rows with an empty id are
+	// never skipped.
+	DedupeByID bool
+	IDColumn   int
+	IDHeader   string
+
+	// VerifyHeader fails before reading any data when the header row
+	// doesn't start with the expected input columns, in order. Further
+	// columns are allowed. The first row is then always the header, rather
+	// than detected as one by its column names.
+	VerifyHeader bool
+
+	// MonthOrder orders the months of the CSV ranking, the month summaries
+	// and the histogram. The users within a month keep their ranking order.
+	MonthOrder MonthOrder
+
+	// OutputTemplate, when set, writes the ranking by executing it once per
+	// month with a TemplateMonth, instead of the OutputFormat writers. It
+	// only applies to the results writer, not to OutputTargets.
+	OutputTemplate *template.Template
+
+	// EmailAliases maps the alias emails of a user to their canonical email.
+	// Transactions of an alias are accounted and reported under the
+	// canonical email, as if the input held it.
+	EmailAliases map[string]string
+
+	// MinActiveDays leaves out of the ranking of a month the users who spent
+	// on fewer distinct days of it, e.g. to exclude one-day bursts. Refunds
+	// don't make a day active.
+	MinActiveDays int
+
+	// IncludeCountRank adds the rank of the user within the month by number
+	// of transactions, next to the rank by spend. Users with the same number
+	// of transactions share a rank, e.g. 1, 2, 2, 4.
+	IncludeCountRank bool
+
+	// GzipOutput compresses the report written to the results writer with
+	// gzip. Snapshots and OutputTargets are written uncompressed.
+	GzipOutput bool
+
+	// TopN is the number of users ranked per month. Zero means the default
+	// of 5, and a negative value ranks every user.
+	TopN int
+
+	// OutputCurrency is the currency amounts are written in, converted from
+	// GBP at GBPToOutputRate units of it per GBP, which must be positive.
+	// UserCurrencyPreference takes precedence for the users it names a
+	// currency for. Defaults to GBP.
+	OutputCurrency  string
+	GBPToOutputRate float64
+
+	// From and To restrict the report to the transactions dated from From
+	// to To, both included. A zero bound leaves that side unbounded.
+	From time.Time
+	To   time.Time
+
+	// CountedTypes lists the transaction types counted as spending, e.g.
+	// "CARD SPEND". Defaults to CARD SPEND only.
+	CountedTypes []string
+
+	// Period is the period spenders are ranked over, one of the Period
+	// values. Defaults to PeriodMonth.
+	Period string
+
+	// Order is the order spenders are ranked in, OrderDesc or OrderAsc.
+	// Defaults to OrderDesc.
+	Order string
+
+	// Delimiter separates the fields of the input, e.g. ';' or '\t'. It
+	// can't be a line break or a double quote. Defaults to a comma.
+	Delimiter rune
+
+	// MinAmount ignores the transactions worth less than it in GBP, or in
+	// their own currency with RankPerCurrency, e.g. 0.01 to leave out
+	// negative and zero amounts. Zero counts every amount.
+	MinAmount float64
+}
+
+// OutputTarget is an additional destination of the report.
+type OutputTarget struct {
+	Writer io.Writer
+	// Filter keeps the rows it returns true for. Nil keeps every row.
+	Filter func(Row) bool
+	// Format is one of the OutputFormat values.
+	Format string
+}
+
+// dailyRateLayout is the date layout of the Config.DailyRates keys.
+const dailyRateLayout = "2006-01-02"
+
+// defaultTopN is the number of users ranked per month by default.
+const defaultTopN = 5
+
+// othersLabel names the row summing the users not listed.
+const othersLabel = "(others)"
+
+// totalLabel names the row summing every user of the month.
+const totalLabel = "TOTAL"
+
+// rankedTotalLabel names the row summing the users listed.
+const rankedTotalLabel = "ranked total"
+
+// TruncatePolicy selects how ties at the end of the ranking are truncated.
+type TruncatePolicy int
+
+const (
+	// HardCut ranks exactly the top spenders, splitting tied users by their
+	// transaction count, then by email.
+	HardCut TruncatePolicy = iota
+	// IncludeTiedGroup extends the ranking to every user tied at the cut.
+	IncludeTiedGroup
+	// ExcludeTiedGroup stops the ranking before the users tied at the cut.
+	ExcludeTiedGroup
+)
+
+// ReportType selects the ranking criteria of the report.
+type ReportType int
+
+const (
+	// TopSpend ranks users by their monthly spend.
+	TopSpend ReportType = iota
+	// TopGrowth ranks users by the growth of their spend compared to the
+	// previous month, reported in a growthGBP column. The first month of
+	// the input is not reported.
+	TopGrowth
+)
+
+const (
+	// AggregationByCategory ranks spenders per merchant category.
+	AggregationByCategory = "by-category"
+
+	categoryOther = "other"
+)
+
+const (
+	// OutputFormatCSV writes one CSV row per ranked user.
+	OutputFormatCSV = ""
+	// OutputFormatJSON writes a JSON array with a Row per CSV row, e.g.
+	// [{"date":"2024/01","rank":1,...}]. Amounts are numbers with as many
+	// decimals as in the CSV.
+	OutputFormatJSON = "json"
+	// OutputFormatJSONNested writes a single JSON object mapping each month
+	// to its ranked rows, e.g. {"2024/01":[{...}],"2024/02":[...]}.
+	OutputFormatJSONNested = "json-nested"
+	// OutputFormatMonthSummaryJSONL writes one JSON line per month
+	// summarising its top spender and its total spend.
+	OutputFormatMonthSummaryJSONL = "month-summary-jsonl"
+	// OutputFormatMatrix writes a CSV pivot of every user's total spend in
+	// the output currency, capped at CapMonthlySpend, one row per email and
+	// one column per month seen, ranked or not. It can't be combined with
+	// RankPerCurrency.
+	OutputFormatMatrix = "matrix"
+
+	// outputFormatCSVName selects OutputFormatCSV by name.
+	outputFormatCSVName = "csv"
+)
+
+const (
+	// PeriodMonth ranks spenders per calendar month, keyed like 202401 and
+	// labelled like 2024/01.
+	PeriodMonth = "month"
+	// PeriodWeek ranks spenders per ISO week, keyed like 202403 and
+	// labelled like 2024-W03. Moving averages, sparklines and growth then
+	// span weeks rather than months.
+	PeriodWeek = "week"
+)
+
+const (
+	// OrderDesc ranks the top spenders, rank 1 spending the most.
+	OrderDesc = "desc"
+	// OrderAsc ranks the bottom spenders, rank 1 spending the least. Tied
+	// users are ranked like with OrderDesc.
+	OrderAsc = "asc"
+)
+
+// periodKey creates a sortable integer key for the period of date.
+func (c *Config) periodKey(date time.Time) int {
+	if c.Period == PeriodWeek {
+		year, week := date.ISOWeek()
+		return year*100 + week
+	}
+	return monthKey(date)
+}
+
+// prevPeriodKey returns the key of the period preceding key.
+func (c *Config) prevPeriodKey(key int) int {
+	if c.Period == PeriodWeek {
+		return c.periodKey(isoWeekStart(key).AddDate(0, 0, -7))
+	}
+	return prevMonthKey(key)
+}
+
+// periodLabel formats a period key for output.
+func (c *Config) periodLabel(key int) string {
+	if c.Period == PeriodWeek {
+		return fmt.Sprintf("%d-W%02d", key/100, key%100)
+	}
+	return monthLabel(key)
+}
+
+// isoWeekStart returns the Monday starting the ISO week of key.
+func isoWeekStart(key int) time.Time {
+	// January 4th is always in the first week.
+	jan4 := time.Date(key/100, time.January, 4, 0, 0, 0, 0, time.UTC)
+	daysSinceMonday := (int(jan4.Weekday()) + 6) % 7
+	return jan4.AddDate(0, 0, (key%100-1)*7-daysSinceMonday)
+}
+
+// category returns the category tx is aggregated in, if any.
+func (c *Config) category(tx *Transaction) string {
+	if c.RankPerCurrency {
+		return tx.FromCurrency
+	}
+	if c.Aggregation != AggregationByCategory {
+		return ""
+	}
+	if category, ok := c.MerchantCategories[tx.MerchantCode]; ok {
+		return category
+	}
+	return categoryOther
+}
+
+// topN returns the number of users ranked out of the given number of users.
+func (c *Config) topN(users int) int {
+	switch {
+	case c.TopPercentile > 0:
+		// Allow for the float error of e.g. 0.07*100 before rounding up.
+		return max(1, int(math.Ceil(c.TopPercentile*float64(users)-1e-9)))
+	case c.TopN < 0:
+		return users
+	case c.TopN > 0:
+		return c.TopN
+	}
+	return defaultTopN
+}
+
+// streamsRanking reports whether the months are ranked by merging their
+// spill files as streams, keeping only the top spenders in memory. It takes
+// ExternalSort and a ranking depending on nothing but the top N spenders
+// by total spend.
+func (c *Config) streamsRanking() bool {
+	return c.ExternalSort && c.TopN >= 0 && c.TopPercentile == 0 &&
+		c.ReportType == TopSpend && !c.RecencyWeighting &&
+		c.TruncatePolicy == HardCut && c.IncludeBottomN == 0 &&
+		!c.IncludeOthersRow && !c.IncludeMonthlyTotals &&
+		len(c.IncludePercentiles) == 0 &&
+		!c.IncludeCountPercentile && !c.IncludeCountRank &&
+		c.MovingAverageMonths == 0 && !c.IncludeSparkline
+}
+
+// lineEnd returns the terminator of the output lines.
+func (c *Config) lineEnd() string {
+	if c.CRLF {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+func (c *Config) logger() *slog.Logger {
+	logger := c.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if c.LogLevel != slog.LevelInfo {
+		logger = slog.New(levelHandler{Handler: logger.Handler(), level: c.LogLevel})
+	}
+	return logger
+}
+
+// levelHandler drops the records below level before they reach Handler.
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.Handler.Enabled(ctx, level)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// displayCurrency returns the currency the user's amounts are written in and
+// the rate converting GBP to it.
+func (c *Config) displayCurrency(email string) (string, float64, error) {
+	var currency string
+	if c.UserCurrencyPreference != nil {
+		currency = c.UserCurrencyPreference(email)
+	}
+	if currency == "" {
+		outputCurrency, rate := c.outputCurrency()
+		return outputCurrency, rate, nil
+	}
+	if currency == currencyGBP {
+		return currencyGBP, 1, nil
+	}
+
+	rate, ok := c.DisplayRates[currency]
+	if !ok || rate <= 0 {
+		return "", 0, fmt.Errorf("no display rate for currency %s", currency)
+	}
+	return currency, rate, nil
+}
+
+// rate returns the rate converting the currency of tx to GBP: the daily
+// rate of DailyRates, else the rate of tx, falling back to Rates when tx has
+// none.
+func (c *Config) rate(tx *Transaction) float64 {
+	if rate, ok := c.dailyRate(tx); ok {
+		return rate
+	}
+	if tx.Rate != 0 {
+		return tx.Rate
+	}
+	return c.Rates[tx.FromCurrency+":"+currencyGBP]
+}
+
+// dailyRate returns the rate of DailyRates for the currency of tx on its
+// day, if any.
+func (c *Config) dailyRate(tx *Transaction) (float64, bool) {
+	if c.DailyRates == nil || tx.FromCurrency != currencyGGM {
+		return 0, false
+	}
+	rate, ok := c.DailyRates[tx.Date.Format(dailyRateLayout)][tx.FromCurrency]
+	return rate, ok && rate > 0
+}
+
+// countedTypes returns the set of the transaction types counted as spending.
+func (c *Config) countedTypes() map[string]bool {
+	if len(c.CountedTypes) == 0 {
+		return map[string]bool{txCardSpend: true}
+	}
+	counted := make(map[string]bool, len(c.CountedTypes))
+	for _, txType := range c.CountedTypes {
+		counted[txType] = true
+	}
+	return counted
+}
+
+// inDateRange reports whether date is within From and To.
+func (c *Config) inDateRange(date time.Time) bool {
+	if !c.From.IsZero() && date.Before(c.From) {
+		return false
+	}
+	return c.To.IsZero() || !date.After(c.To)
+}
+
+// outputCurrency returns the currency amounts are written in by default, and
+// the rate converting GBP to it.
+func (c *Config) outputCurrency() (string, float64) {
+	if c.OutputCurrency == "" || c.OutputCurrency == currencyGBP {
+		return currencyGBP, 1
+	}
+	return c.OutputCurrency, c.GBPToOutputRate
+}
+
+// dateTimeColumns returns the indices of the date and time columns when
+// Config.SeparateDateTime is set.
+func (c *Config) dateTimeColumns() (int, int) {
+	dateColumn, timeColumn := c.DateColumn, c.TimeColumn
+	if dateColumn == 0 {
+		dateColumn = 9
+	}
+	if timeColumn == 0 {
+		timeColumn = 10
+	}
+	return dateColumn, timeColumn
+}
+
+func (c *Config) dateLayouts() []string {
+	if len(c.DateLayouts) > 0 {
+		return c.DateLayouts
+	}
+	return []string{timeLayout}
+}
+
+// EmptyResultBehavior selects what is written when there are no results.
+type EmptyResultBehavior int
+
+const (
+	// HeaderOnly writes just the header line.
+	HeaderOnly EmptyResultBehavior = iota
+	// NoOutput writes nothing at all.
+	NoOutput
+	// ErrorOnEmpty writes nothing and returns ErrEmptyResult.
+	ErrorOnEmpty
+)
+
+// MonthOrder selects the order of the months in the report.
+type MonthOrder int
+
+const (
+	// MonthOrderAsc writes the earliest month first.
+	MonthOrderAsc MonthOrder = iota
+	// MonthOrderDesc writes the latest month first.
+	MonthOrderDesc
+)
+
+// ErrEmptyResult is returned when there are no results and ErrorOnEmpty is set.
+var ErrEmptyResult = errors.New("no card spending to report")
+
+type parsedTx struct {
+	tx  *Transaction
+	err error
+	// fatal marks errors stopping the processing regardless of StopOnError.
+	fatal bool
+	// record is the raw input row, kept for reporting rejected rows.
+	record []string
+	// line is the 1-based input line the row starts on, 0 if unknown.
+	line int
+}
+
+// TopSpenders processes a CSV of transactions and writes the top spenders per
+// month, 5 unless Config.TopN says otherwise. A first row naming the input
+// columns is skipped as the header, any other is read as data.
+func TopSpenders(transactionsList io.Reader, results io.Writer, cfg Config) error {
+	return topSpenders([]Source{{Reader: transactionsList}}, results, cfg, false)
+}
+
+// Source is a named input of TopSpendersMulti.
+type Source struct {
+	// Name identifies the source in the rejected rows, e.g. its file name.
+	Name   string
+	Reader io.Reader
+}
+
+// TopSpendersMulti is like TopSpenders, aggregating the transactions of all
+// the sources together. Every source may start with its own header row,
+// unless HeaderSource is set. Rejected rows carry the name of their source in a
+// column after the error.
+func TopSpendersMulti(sources []Source, results io.Writer, cfg Config) error {
+	return topSpenders(sources, results, cfg, true)
+}
+
+func topSpenders(sources []Source, results io.Writer, cfg Config, named bool) error {
+	// Fail before reading the input rather than after.
+	if _, err := outputColumns(cfg); err != nil {
+		return err
+	}
+	if err := checkOutputFormat(cfg.OutputFormat, cfg); err != nil {
+		return err
+	}
+	for _, target := range cfg.OutputTargets {
+		if err := checkOutputFormat(target.Format, cfg); err != nil {
+			return err
+		}
+	}
+	if currency, rate := cfg.outputCurrency(); rate <= 0 {
+		return fmt.Errorf("invalid rate for output currency %s: %v", currency, rate)
+	}
+
+	aggregates, rankings, err := computeRankings(sources, cfg, named)
+	if aggregates != nil {
+		defer aggregates.close()
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeResults(aggregates, rankings, results, cfg); err != nil {
+		return err
+	}
+	return writeOutputTargets(aggregates, rankings, cfg)
+}
+
+// MonthlyRanking is the ranking of the spenders of a month.
+type MonthlyRanking struct {
+	// Month is given as yyyymm, e.g. 202401, or as yyyyww with PeriodWeek.
+	Month int
+	// Spenders holds the ranked users in the order of the report, without
+	// the synthetic rows like the others row.
+	Spenders []*UserMonthlySpending
+}
+
+// ComputeTopSpenders is like TopSpenders, returning the rankings of every
+// month, earliest first, rather than writing them. The output options of
+// cfg are ignored.
+func ComputeTopSpenders(transactionsList io.Reader, cfg Config) ([]MonthlyRanking, error) {
+	aggregates, rankings, err := computeRankings([]Source{{Reader: transactionsList}}, cfg, false)
+	if aggregates != nil {
+		defer aggregates.close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]MonthlyRanking, 0, len(rankings))
+	for _, ranking := range rankings {
+		result = append(result, MonthlyRanking{Month: ranking.month, Spenders: ranking.spendings()})
+	}
+	return result, nil
+}
+
+// ParseTransactions decodes and validates the transactions of a CSV input like
+// TopSpenders, without aggregating them. Every valid row is returned, in the
+// order of the input, whatever its type or date. Invalid rows are reported
+// and skipped like by TopSpenders, or returned as the error with StopOnError.
+func ParseTransactions(transactionsList io.Reader, cfg Config) ([]*Transaction, error) {
+	if err := checkDelimiter(cfg.Delimiter); err != nil {
+		return nil, err
+	}
+	if err := checkIDColumn(cfg); err != nil {
+		return nil, err
+	}
+	// The transactions are handed over, they can't be recycled.
+	cfg.ReuseTransactions = false
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := &processor{cfg: &cfg}
+	if cfg.RejectsWriter != nil {
+		p.rejects = newCSVWriter(cfg.RejectsWriter, cfg)
+		defer p.rejects.Flush()
+	}
+
+	var transactions []*Transaction
+	for parsed := range newTxStream(ctx, transactionsList, cfg) {
+		if parsed.err != nil {
+			if parsed.fatal {
+				return nil, parsed.err
+			}
+			if err := p.inputError(parsed, parsed.err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		transactions = append(transactions, parsed.tx)
+	}
+
+	if p.rejects != nil {
+		p.rejects.Flush()
+		if err := p.rejects.Error(); err != nil {
+			return nil, fmt.Errorf("writing rejected rows: %w", err)
+		}
+	}
+	return transactions, nil
+}
+
+// computeRankings aggregates the transactions of every source and ranks the
+// spenders of every month. The aggregates are returned even on error when
+// created, for the caller to close.
+func computeRankings(sources []Source, cfg Config, named bool) (*aggregator, []*monthRanking, error) {
+	switch cfg.Period {
+	case "", PeriodMonth, PeriodWeek:
+	default:
+		return nil, nil, fmt.Errorf("unknown period: %s", cfg.Period)
+	}
+	switch cfg.Order {
+	case "", OrderDesc, OrderAsc:
+	default:
+		return nil, nil, fmt.Errorf("unknown order: %s", cfg.Order)
+	}
+	if err := checkDelimiter(cfg.Delimiter); err != nil {
+		return nil, nil, err
+	}
+	if err := checkIDColumn(cfg); err != nil {
+		return nil, nil, err
+	}
+	for _, txType := range cfg.CountedTypes {
+		if !knownType(txType) {
+			return nil, nil, fmt.Errorf("unknown counted transaction type: %s", txType)
+		}
+	}
+
+	// Every source is read with the same header.
+	var header []byte
+	if cfg.HeaderSource != nil && len(sources) > 1 {
+		var err error
+		if header, err = io.ReadAll(cfg.HeaderSource); err != nil {
+			return nil, nil, fmt.Errorf("reading header: %w", err)
+		}
+	}
+
+	// The context stops reading the input when we return early or run out
+	// of time.
+	ctx := context.Background()
+	if cfg.TimeBudget > 0 {
+		var cancelBudget context.CancelFunc
+		ctx, cancelBudget = context.WithTimeout(ctx, cfg.TimeBudget)
+		defer cancelBudget()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := &processor{
+		cfg:        &cfg,
+		aggregates: newAggregator(&cfg),
+		named:      named,
+	}
+
+	if cfg.RejectsWriter != nil {
+		p.rejects = newCSVWriter(cfg.RejectsWriter, cfg)
+		// Flush what was rejected so far even if we stop early.
+		defer p.rejects.Flush()
+	}
+
+	started := time.Now()
+	for _, source := range sources {
+		streamCfg := cfg
+		if header != nil {
+			streamCfg.HeaderSource = bytes.NewReader(header)
+		}
+
+		// Streaming on channels allows us not to fit he entire list in memory.
+		transactions := newTxStream(ctx, source.Reader, streamCfg)
+		p.source = source.Name
+		if err := p.consume(ctx, transactions); err != nil {
+			return p.aggregates, nil, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if elapsed := time.Since(started); cfg.SlowThreshold > 0 && elapsed > cfg.SlowThreshold {
+		cfg.logger().Warn("slow processing", "elapsed", elapsed, "threshold", cfg.SlowThreshold, "rows", p.rowsProcessed)
+	}
+
+	if cfg.RateVarianceThreshold > 0 {
+		p.checkRateVariance()
+	}
+
+	if p.rejects != nil {
+		p.rejects.Flush()
+		if err := p.rejects.Error(); err != nil {
+			return p.aggregates, nil, fmt.Errorf("writing rejected rows: %w", err)
+		}
+	}
+
+	rankings, err := rankMonths(p.aggregates, cfg)
+	if err != nil {
+		return p.aggregates, nil, err
+	}
+	if cfg.OnMonthComplete != nil {
+		for _, ranking := range rankings {
+			cfg.OnMonthComplete(ranking.month, ranking.spendings())
+		}
+	}
+	return p.aggregates, rankings, nil
+}
+
+// consume processes the transactions until the stream ends or ctx is done.
+func (p *processor) consume(ctx context.Context, transactions chan parsedTx) error {
+	cfg := p.cfg
+	for {
+		var parsed parsedTx
+		select {
+		case <-ctx.Done():
+			cfg.logger().Warn("time budget elapsed, the report is partial", "rows", p.rowsProcessed, "lastDate", p.lastDate.Format(cfg.dateLayouts()[0]))
+			return nil
+		case next, ok := <-transactions:
+			if !ok {
+				return nil
+			}
+			parsed = next
+		}
+
+		p.rowsProcessed++
+		if parsed.tx != nil {
+			p.lastDate = parsed.tx.Date
+		}
+
+		err := p.process(parsed)
+		if cfg.ReuseTransactions && parsed.tx != nil {
+			// Nothing holds on to the transaction once it is processed.
+			txPool.Put(parsed.tx)
+		}
+		if err != nil {
+			return err
+		}
+
+		if cfg.SnapshotWriter != nil && cfg.SnapshotEvery > 0 && p.rowsProcessed%cfg.SnapshotEvery == 0 {
+			// Snapshots are best-effort, they must not fail the run.
+			if err := writeMonthlySpendings(p.aggregates, cfg.SnapshotWriter, *cfg); err != nil {
+				cfg.logger().Warn("failed to write snapshot", "rows", p.rowsProcessed, "error", err)
+			}
+		}
+	}
+}
+
+func checkOutputFormat(format string, cfg Config) error {
+	switch format {
+	case OutputFormatMatrix:
+		// The totals of the currencies of a user can't share a cell.
+		if cfg.RankPerCurrency {
+			return fmt.Errorf("output format %s can't rank per currency", format)
+		}
+		return nil
+	case OutputFormatCSV, outputFormatCSVName, OutputFormatJSON, OutputFormatJSONNested, OutputFormatMonthSummaryJSONL:
+		return nil
+	}
+	return fmt.Errorf("unknown output format: %s", format)
+}
+
+// processor aggregates the parsed rows of the input.
+type processor struct {
+	cfg        *Config
+	aggregates *aggregator
+	rejects    recordWriter
+
+	// rates holds the range of rates seen per month and currency pair.
+	rates map[rateKey]*rateRange
+	// live ranks the users of the current month for Config.OnRankChange.
+	live *liveRanking
+	// seenIDs holds the transaction ids read for Config.DedupeByID.
+	seenIDs map[string]bool
+	// counted is the set of Config.CountedTypes.
+	counted map[string]bool
+
+	// source names the input being read, reported in the rejected rows
+	// when named is set.
+	source string
+	named  bool
+
+	rowsProcessed int
+	// lastDate is the date of the last transaction read.
+	lastDate time.Time
+}
+
+type rateKey struct {
+	month int
+	pair  string
+}
+
+type rateRange struct {
+	min, max float64
+}
+
+func (p *processor) trackRate(tx *Transaction) {
+	if tx.Rate <= 0 {
+		return
+	}
+	if p.rates == nil {
+		p.rates = map[rateKey]*rateRange{}
+	}
+
+	key := rateKey{month: monthKey(tx.Date), pair: tx.FromCurrency + ":" + tx.ToCurrency}
+	r, ok := p.rates[key]
+	if !ok {
+		p.rates[key] = &rateRange{min: tx.Rate, max: tx.Rate}
+		return
+	}
+	r.min = min(r.min, tx.Rate)
+	r.max = max(r.max, tx.Rate)
+}
+
+// checkRateVariance warns about the months where the rates of a currency pair
+// vary more than Config.RateVarianceThreshold allows.
+func (p *processor) checkRateVariance() {
+	keys := make([]rateKey, 0, len(p.rates))
+	for key := range p.rates {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].month != keys[j].month {
+			return keys[i].month < keys[j].month
+		}
+		return keys[i].pair < keys[j].pair
+	})
+
+	for _, key := range keys {
+		r := p.rates[key]
+		if ratio := r.max / r.min; ratio > p.cfg.RateVarianceThreshold {
+			p.cfg.logger().Warn("inconsistent rates",
+				"month", monthLabel(key.month),
+				"pair", key.pair,
+				"min", r.min,
+				"max", r.max,
+				"ratio", ratio,
+			)
+		}
+	}
+}
+
+// process accounts a single parsed row. It returns an error if processing
+// should stop.
+func (p *processor) process(parsed parsedTx) error {
+	if parsed.err != nil {
+		if parsed.fatal {
+			return parsed.err
+		}
+		return p.inputError(parsed, parsed.err)
+	}
+
+	tx := parsed.tx
+	if !p.cfg.inDateRange(tx.Date) {
+		return nil
+	}
+	if p.cfg.DedupeByID && tx.ID != "" {
+		if p.seenIDs[tx.ID] {
+			return nil
+		}
+		if p.seenIDs == nil {
+			p.seenIDs = map[string]bool{}
+		}
+		p.seenIDs[tx.ID] = true
+	}
+	if canonical, ok := p.cfg.EmailAliases[tx.Email]; ok {
+		// Copy rather than modify tx, it may be the caller's of Aggregator.Add.
+		aliased := *tx
+		aliased.Email = canonical
+		tx = &aliased
+	}
+	if p.cfg.RateVarianceThreshold > 0 {
+		p.trackRate(tx)
+	}
+	if p.counted == nil {
+		p.counted = p.cfg.countedTypes()
+	}
+	counted := p.counted[tx.TransactionType] || (tx.TransactionType == txRefund && p.cfg.RefundsReduceSpend)
+	if !counted {
+		if p.cfg.ExpectOnlySpend {
+			return p.inputError(parsed, fmt.Errorf("unexpected transaction type: %s", tx.TransactionType))
+		}
+		// We are only interested in spending, 'CARD SPEND' by default.
+		return nil
+	}
+	if p.cfg.SkipZeroAmount && tx.Amount == 0 {
+		return nil
+	}
+	if p.cfg.NameContains != "" && !tx.nameContains(p.cfg.NameContains) {
+		return nil
+	}
+	if p.cfg.RequireConvertible {
+		if _, _, err := p.cfg.displayCurrency(tx.Email); err != nil {
+			return p.inputError(parsed, err)
+		}
+	}
+	if p.cfg.RequireDailyRate && p.cfg.DailyRates != nil && tx.FromCurrency == currencyGGM {
+		if _, ok := p.cfg.dailyRate(tx); !ok {
+			return p.inputError(parsed, fmt.Errorf("no daily rate for %s on %s", tx.FromCurrency, tx.Date.Format(dailyRateLayout)))
+		}
+	}
+	if p.cfg.MinAmount != 0 && rankedAmount(tx, p.cfg) < p.cfg.MinAmount {
+		return nil
+	}
+	if p.cfg.OnRankChange != nil {
+		if err := p.trackRank(tx); err != nil {
+			return err
+		}
+	}
+	return p.aggregates.add(tx)
+}
+
+// inputError reports a row that is skipped because of err. It returns err if
+// processing should stop.
+func (p *processor) inputError(parsed parsedTx, err error) error {
+	// Skipped rows report the line apart from the error.
+	rowErr := err
+	// The CSV parse errors name their line already.
+	if parseErr := (*csv.ParseError)(nil); parsed.line > 0 && !errors.As(err, &parseErr) {
+		err = fmt.Errorf("line %d: %w", parsed.line, err)
+	}
+
+	if p.rejects != nil && parsed.record != nil {
+		record := append(parsed.record, err.Error())
+		if p.named {
+			record = append(record, p.source)
+		}
+		if err := p.rejects.Write(record); err != nil {
+			return fmt.Errorf("writing rejected row: %w", err)
+		}
+	}
+	if p.cfg.ErrorWriter != nil {
+		row := SkippedRow{Line: parsed.line, Record: parsed.record, Error: rowErr.Error()}
+		if p.named {
+			row.Source = p.source
+		}
+		if err := writeJSONLine(p.cfg.ErrorWriter, row, *p.cfg); err != nil {
+			return fmt.Errorf("writing skipped row: %w", err)
+		}
+	}
+	if p.cfg.StopOnError {
+		return err
+	}
+	if p.cfg.ErrorWriter == nil {
+		p.cfg.logger().Error("input error", "error", err)
+	}
+	return nil
+}
+
+// newCSVWriter returns a CSV writer using the line endings selected in cfg.
+func newCSVWriter(w io.Writer, cfg Config) recordWriter {
+	if cfg.QuoteAllFields {
+		return &quotedWriter{w: bufio.NewWriter(w), lineEnd: cfg.lineEnd()}
+	}
+	csvWriter := csv.NewWriter(w)
+	csvWriter.UseCRLF = cfg.CRLF
+	return csvWriter
+}
+
+// recordWriter writes CSV records, buffered until flushed like csv.Writer.
+type recordWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
+
+// quotedWriter writes CSV records with every field quoted, where csv.Writer
+// only quotes the fields that need it.
+type quotedWriter struct {
+	w       *bufio.Writer
+	lineEnd string
+	err     error
+}
+
+func (q *quotedWriter) Write(record []string) error {
+	if q.err != nil {
+		return q.err
+	}
+	for i, field := range record {
+		if i > 0 {
+			q.w.WriteByte(',')
+		}
+		q.w.WriteByte('"')
+		q.w.WriteString(strings.ReplaceAll(field, `"`, `""`))
+		q.w.WriteByte('"')
+	}
+	// bufio.Writer errors are sticky, the last write reports any of them.
+	_, q.err = q.w.WriteString(q.lineEnd)
+	return q.err
+}
+
+func (q *quotedWriter) Flush() {
+	if q.err == nil {
+		q.err = q.w.Flush()
+	}
+}
+
+func (q *quotedWriter) Error() error {
+	return q.err
+}
+
+// reportRow is a single ranked line of the report.
+type reportRow struct {
+	month int
+	rank  int
+	// label replaces the rank of synthetic rows.
+	label    string
+	spending *UserMonthlySpending
+	// currency is the display currency of the amount, rate converts GBP to it.
+	currency string
+	rate     float64
+	// bottom marks rows of the bottom spenders requested by IncludeBottomN.
+	bottom bool
+	// score is what the row was ranked by.
+	score float64
+
+	movingAvgGBP    float64
+	sparkline       []float64
+	countPercentile float64
+	countRank       int
+
+	// placeholder marks the rows padding the ranking for PadToTopN.
+	placeholder bool
+}
+
+// synthetic reports whether the row doesn't stand for a single user.
+func (r *reportRow) synthetic() bool {
+	return r.label != "" || r.placeholder
+}
+
+type column struct {
+	name string
+	// typ is the type of the values, described by IncludeSchemaComment.
+	typ   string
+	value func(r *reportRow) string
+}
+
+// Column types described by Config.IncludeSchemaComment.
+const (
+	typeString = "string"
+	typeInt    = "int"
+	typeFloat  = "float"
+)
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', currencyPrecisionDecimals, 64)
+}
+
+// localeDecimals is the number of decimals of locale formatted amounts.
+const localeDecimals = 2
+
+// formatGrouped formats amount with comma thousands separators, e.g. 2,500.00.
+func formatGrouped(amount float64, decimals int) string {
+	formatted := strconv.FormatFloat(amount, 'f', decimals, 64)
+	sign := ""
+	if strings.HasPrefix(formatted, "-") {
+		sign, formatted = "-", formatted[1:]
+	}
+	integer, fraction, hasFraction := strings.Cut(formatted, ".")
+
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+	if hasFraction {
+		b.WriteByte('.')
+		b.WriteString(fraction)
+	}
+	return b.String()
+}
+
+// currencySymbols holds the symbols used for human formatted amounts.
+// Other currencies, including GGM, are written with their code.
+var currencySymbols = map[string]string{
+	currencyGBP: "£",
+	"EUR":       "€",
+	"USD":       "$",
+}
+
+// formatHuman formats amount for people, with the currency symbol and
+// thousands separators, e.g. £2,500.00 or GGM 1,000.00.
+func formatHuman(amount float64, currency string) string {
+	prefix, ok := currencySymbols[currency]
+	if !ok {
+		prefix = currency + " "
+	}
+	grouped := formatGrouped(amount, localeDecimals)
+	if strings.HasPrefix(grouped, "-") {
+		return "-" + prefix + grouped[1:]
+	}
+	return prefix + grouped
+}
+
+// reportColumns returns the output columns in order, including the optional
+// ones enabled in cfg.
+func reportColumns(cfg Config) []column {
+	// Labelled rows write text in place of the rank.
+	rankType := typeInt
+	if cfg.IncludeOthersRow || cfg.IncludeMonthlyTotals || cfg.IncludeMonthTotal || len(cfg.IncludePercentiles) > 0 {
+		rankType = typeString
+	}
+	// Formatted amounts no longer parse as numbers.
+	amountType := typeFloat
+	if cfg.HumanAmounts || cfg.LocaleFormat {
+		amountType = typeString
+	}
+
+	columns := []column{
+		{"date", typeString, func(r *reportRow) string { return cfg.periodLabel(r.month) }},
+		{"rank", rankType, func(r *reportRow) string {
+			if r.label != "" {
+				return r.label
+			}
+			return strconv.Itoa(r.rank)
+		}},
+		{"amount", amountType, func(r *reportRow) string {
+			if cfg.ExactAmountStrings {
+				amount := new(big.Rat)
+				if r.spending.exactGBP != nil {
+					amount.Mul(r.spending.exactGBP, exactRat(r.rate))
+				}
+				return formatExact(amount)
+			}
+			if cfg.HumanAmounts {
+				return formatHuman(r.spending.TotalGBP.Float64()*r.rate, r.currency)
+			}
+			if cfg.LocaleFormat {
+				return formatGrouped(r.spending.TotalGBP.Float64()*r.rate, localeDecimals)
+			}
+			if r.rate == 1 {
+				return r.spending.TotalGBP.String()
+			}
+			return formatAmount(r.spending.TotalGBP.Float64() * r.rate)
+		}},
+		{"currency", typeString, func(r *reportRow) string { return r.currency }},
+		{"transactions", typeInt, func(r *reportRow) string { return strconv.Itoa(r.spending.TransactionCount) }},
+		{"email", typeString, func(r *reportRow) string { return r.spending.Email }},
+		{"firstName", typeString, func(r *reportRow) string { return r.spending.FirstName }},
+		{"lastName", typeString, func(r *reportRow) string { return r.spending.LastName }},
+	}
+
+	if cfg.MovingAverageMonths > 0 {
+		columns = append(columns, column{"movingAvgGBP", typeFloat, func(r *reportRow) string { return formatAmount(r.movingAvgGBP) }})
+	}
+
+	if cfg.ReportType == TopGrowth {
+		columns = append(columns, column{"growthGBP", typeFloat, func(r *reportRow) string { return formatAmount(r.score) }})
+	}
+
+	if cfg.IncludeBottomN > 0 {
+		columns = append(columns, column{"segment", typeString, func(r *reportRow) string {
+			if r.bottom {
+				return "bottom"
+			}
+			return "top"
+		}})
+	}
+
+	if cfg.Aggregation == AggregationByCategory {
+		columns = append(columns, column{"category", typeString, func(r *reportRow) string { return r.spending.Category }})
+	}
+
+	if cfg.IncludeDistinctMerchants {
+		columns = append(columns, column{"distinctMerchants", typeInt, func(r *reportRow) string { return strconv.Itoa(len(r.spending.merchants)) }})
+	}
+
+	if cfg.IncludeCountPercentile {
+		columns = append(columns, column{"countPercentile", typeFloat, func(r *reportRow) string { return strconv.FormatFloat(r.countPercentile, 'f', localeDecimals, 64) }})
+	}
+
+	if cfg.IncludeCountRank {
+		columns = append(columns, column{"countRank", typeInt, func(r *reportRow) string { return strconv.Itoa(r.countRank) }})
+	}
+
+	if cfg.CountRefundsSeparately {
+		columns = append(columns,
+			column{"grossGBP", typeFloat, func(r *reportRow) string { return formatAmount(r.spending.GrossGBP().Float64()) }},
+			column{"refunds", typeInt, func(r *reportRow) string { return strconv.Itoa(r.spending.RefundCount) }},
+		)
+	}
+
+	if cfg.IncludeSparkline {
+		columns = append(columns, column{"sparkline", typeString, func(r *reportRow) string {
+			values := make([]string, len(r.sparkline))
+			for i, v := range r.sparkline {
+				values[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+			return strings.Join(values, ",")
+		}})
+	}
+
+	return columns
+}
+
+// outputColumns returns the report columns selected by cfg.OutputColumns in
+// the order given, or every column when it is empty.
+func outputColumns(cfg Config) ([]column, error) {
+	columns := reportColumns(cfg)
+	if len(cfg.OutputColumns) == 0 {
+		return columns, nil
+	}
+
+	selected := make([]column, 0, len(cfg.OutputColumns))
+	for _, name := range cfg.OutputColumns {
+		i := slices.IndexFunc(columns, func(c column) bool { return c.name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown output column: %s", name)
+		}
+		selected = append(selected, columns[i])
+	}
+	return selected, nil
+}
+
+// monthRanking holds the ranked report rows of a single month.
+type monthRanking struct {
+	month int
+	rows  []*reportRow
+}
+
+// spendings returns the spending of the ranked users, in the order of the
+// rows, leaving out the synthetic rows.
+func (r *monthRanking) spendings() []*UserMonthlySpending {
+	spendings := make([]*UserMonthlySpending, 0, len(r.rows))
+	for _, row := range r.rows {
+		if !row.synthetic() {
+			spendings = append(spendings, row.spending)
+		}
+	}
+	return spendings
+}
+
+// rankMonths ranks the spenders of every month, ordered by month.
+func rankMonths(aggregates *aggregator, cfg Config) ([]*monthRanking, error) {
+	monthsSeen := aggregates.monthKeys()
+	rankings := make([]*monthRanking, 0, len(monthsSeen))
+	for i, key := range monthsSeen {
+		if cfg.ReportType == TopGrowth && i == 0 {
+			// There is no prior month to grow from.
+			continue
+		}
+		var month map[string]*UserMonthlySpending
+		var err error
+		if cfg.streamsRanking() {
+			month, err = topOfMonth(aggregates, key, cfg)
+		} else {
+			month, err = rankedMonth(aggregates, key, cfg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cfg.MinActiveDays > 0 {
+			month = activeSpenders(month, cfg.MinActiveDays)
+		}
+
+		// scores overrides TotalGBP as the ranking criteria.
+		var scores map[string]float64
+		if cfg.ReportType == TopGrowth {
+			scores, err = growth(aggregates, key, month, cfg)
+			if err != nil {
+				return nil, err
+			}
+		} else if cfg.RecencyWeighting {
+			scores = make(map[string]float64, len(month))
+			for userKey, us := range month {
+				scores[userKey] = us.weightedGBP
+			}
+		}
+
+		ranking := &monthRanking{month: key}
+		for _, group := range groupSpendings(month) {
+			rows, err := rankGroup(aggregates, key, group, scores, cfg)
+			if err != nil {
+				return nil, err
+			}
+			ranking.rows = append(ranking.rows, rows...)
+		}
+		// A month without ranked users has nothing to total.
+		if cfg.IncludeMonthTotal && len(ranking.spendings()) > 0 {
+			ranking.rows = append(ranking.rows, rankedTotalRow(key, ranking.rows, cfg))
+		}
+		if len(cfg.IncludePercentiles) > 0 {
+			ranking.rows = append(ranking.rows, percentileRows(key, month, cfg)...)
+		}
+		if cfg.IncludeMonthlyTotals {
+			ranking.rows = append(ranking.rows, totalRow(key, month, cfg))
+		}
+		rankings = append(rankings, ranking)
+	}
+
+	if cfg.OnlyConsistentSpenders {
+		rankings = keepConsistentSpenders(rankings)
+	}
+
+	return rankings, nil
+}
+
+// rankedMonth returns the spending of every user in the month as ranked,
+// i.e. with the totals capped at Config.CapMonthlySpend.
+func rankedMonth(aggregates *aggregator, key int, cfg Config) (map[string]*UserMonthlySpending, error) {
+	month, err := aggregates.month(key)
+	if err != nil || cfg.CapMonthlySpend <= 0 {
+		return month, err
+	}
+
+	capped := make(map[string]*UserMonthlySpending, len(month))
+	for userKey, us := range month {
+		capped[userKey] = capSpending(us, cfg)
+	}
+	return capped, nil
+}
+
+// capSpending returns us with its total capped at Config.CapMonthlySpend.
+func capSpending(us *UserMonthlySpending, cfg Config) *UserMonthlySpending {
+	if cfg.CapMonthlySpend <= 0 || us.TotalGBP.Float64() <= cfg.CapMonthlySpend {
+		return us
+	}
+	// Copy rather than modify the aggregates, they may be ranked again.
+	c := *us
+	c.TotalGBP = DecimalFromFloat(cfg.CapMonthlySpend)
+	if us.exactGBP != nil {
+		c.exactGBP = exactRat(cfg.CapMonthlySpend)
+	}
+	return &c
+}
+
+// topOfMonth returns the top spenders of every group of the month as ranked,
+// like rankedMonth followed by activeSpenders, but merging the sorted runs of
+// the month as streams and keeping at most the top N spenders of each group
+// in memory. It serves the rankings for which Config.streamsRanking holds.
+func topOfMonth(aggregates *aggregator, key int, cfg Config) (map[string]*UserMonthlySpending, error) {
+	n := cfg.topN(0)
+	byCategory := map[string][]*UserMonthlySpending{}
+	err := aggregates.mergeRuns(key, func(us *UserMonthlySpending) {
+		if cfg.MinActiveDays > 0 && bits.OnesCount32(us.activeDays) < cfg.MinActiveDays {
+			return
+		}
+		us = capSpending(us, cfg)
+		top := byCategory[us.Category]
+		i := sort.Search(len(top), func(i int) bool { return ranksBefore(us, top[i], cfg) })
+		if i >= n {
+			return
+		}
+		top = slices.Insert(top, i, us)
+		byCategory[us.Category] = top[:min(len(top), n)]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	month := map[string]*UserMonthlySpending{}
+	for _, top := range byCategory {
+		for _, us := range top {
+			month[us.key()] = us
+		}
+	}
+	return month, nil
+}
+
+// ranksBefore reports whether a ranks before b by total spend, in the order
+// of the report.
+func ranksBefore(a, b *UserMonthlySpending, cfg Config) bool {
+	if sa, sb := a.TotalGBP.Float64(), b.TotalGBP.Float64(); sa != sb {
+		return (sa > sb) != (cfg.Order == OrderAsc)
+	}
+	return tieBreak(a, b)
+}
+
+// activeSpenders returns the spending of the users of month who spent on at
+// least minDays distinct days.
+func activeSpenders(month map[string]*UserMonthlySpending, minDays int) map[string]*UserMonthlySpending {
+	active := make(map[string]*UserMonthlySpending, len(month))
+	for userKey, us := range month {
+		if bits.OnesCount32(us.activeDays) >= minDays {
+			active[userKey] = us
+		}
+	}
+	return active
+}
+
+// groupSpendings splits the spendings of a month into the groups ranked
+// separately, i.e. one group per category when aggregating by category.
+// Groups are ordered by category.
+func groupSpendings(month map[string]*UserMonthlySpending) [][]*UserMonthlySpending {
+	byCategory := map[string][]*UserMonthlySpending{}
+	for _, spendings := range month {
+		byCategory[spendings.Category] = append(byCategory[spendings.Category], spendings)
+	}
+
+	categories := make([]string, 0, len(byCategory))
+	for category := range byCategory {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	groups := make([][]*UserMonthlySpending, 0, len(categories))
+	for _, category := range categories {
+		groups = append(groups, byCategory[category])
+	}
+	return groups
+}
+
+// rankGroup ranks userSpendings of month key and returns the top spenders' rows.
+// Users are ranked by their scores when given, by TotalGBP otherwise, and
+// tied users by tieBreak.
+func rankGroup(aggregates *aggregator, key int, userSpendings []*UserMonthlySpending, scores map[string]float64, cfg Config) ([]*reportRow, error) {
+	score := func(us *UserMonthlySpending) float64 {
+		if scores != nil {
+			return scores[us.key()]
+		}
+		return us.TotalGBP.Float64()
+	}
+	sort.Slice(userSpendings, func(i int, j int) bool {
+		// sort descending by score, ascending with OrderAsc
+		if si, sj := score(userSpendings[i]), score(userSpendings[j]); si != sj {
+			return (si > sj) != (cfg.Order == OrderAsc)
+		}
+		return tieBreak(userSpendings[i], userSpendings[j])
+	})
+
+	topN := cfg.topN(len(userSpendings))
+	if len(userSpendings) < topN {
+		topN = len(userSpendings)
+	}
+	// Check whether the cut splits a group of tied users.
+	tied := func(i int) bool {
+		return i > 0 && i < len(userSpendings) && score(userSpendings[i]) == score(userSpendings[i-1])
+	}
+	switch cfg.TruncatePolicy {
+	case IncludeTiedGroup:
+		for tied(topN) {
+			topN++
+		}
+	case ExcludeTiedGroup:
+		if tied(topN) {
+			for tied(topN - 1) {
+				topN--
+			}
+			topN--
+		}
+	}
+
+	ranked := make([]int, 0, topN+cfg.IncludeBottomN)
+	for i := 0; i < topN; i++ {
+		ranked = append(ranked, i)
+	}
+	// The bottom spenders never overlap with the top ones.
+	bottomFrom := max(topN, len(userSpendings)-cfg.IncludeBottomN)
+	for i := bottomFrom; i < len(userSpendings); i++ {
+		ranked = append(ranked, i)
+	}
+
+	var counts []int
+	if cfg.IncludeCountPercentile || cfg.IncludeCountRank {
+		counts = make([]int, len(userSpendings))
+		for i, us := range userSpendings {
+			counts[i] = us.TransactionCount
+		}
+		sort.Ints(counts)
+	}
+
+	// Amounts are in the output currency, or in the currency of the group
+	// when ranking per currency.
+	groupCurrency, groupRate := cfg.outputCurrency()
+	if cfg.RankPerCurrency {
+		groupCurrency, groupRate = userSpendings[0].Category, 1
+	}
+
+	rows := make([]*reportRow, 0, len(ranked))
+	for _, i := range ranked {
+		row := &reportRow{
+			month:    key,
+			rank:     i + 1,
+			spending: userSpendings[i],
+			bottom:   i >= topN,
+			score:    score(userSpendings[i]),
+		}
+
+		var err error
+		if cfg.RankPerCurrency {
+			row.currency, row.rate = groupCurrency, groupRate
+		} else {
+			row.currency, row.rate, err = cfg.displayCurrency(row.spending.Email)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if cfg.MovingAverageMonths > 0 {
+			row.movingAvgGBP, err = movingAverage(aggregates, key, row.spending.key(), cfg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if cfg.IncludeSparkline {
+			row.sparkline, err = sparkline(aggregates, key, row.spending.key(), cfg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if cfg.IncludeCountPercentile {
+			row.countPercentile = countPercentile(counts, row.spending.TransactionCount)
+		}
+		if cfg.IncludeCountRank {
+			row.countRank = countRank(counts, row.spending.TransactionCount)
+		}
+		rows = append(rows, row)
+	}
+
+	if cfg.PadToTopN {
+		for i := len(userSpendings); i < cfg.topN(len(userSpendings)); i++ {
+			rows = append(rows, &reportRow{
+				month:       key,
+				rank:        i + 1,
+				spending:    &UserMonthlySpending{Category: userSpendings[0].Category},
+				currency:    groupCurrency,
+				rate:        groupRate,
+				placeholder: true,
+			})
+		}
+	}
+
+	if cfg.IncludeOthersRow && bottomFrom > topN {
+		others := &UserMonthlySpending{Category: userSpendings[0].Category}
+		for _, us := range userSpendings[topN:bottomFrom] {
+			others.merge(us)
+		}
+		others.Email, others.FirstName, others.LastName = othersLabel, "", ""
+		rows = append(rows, &reportRow{
+			month:    key,
+			label:    othersLabel,
+			spending: others,
+			currency: groupCurrency,
+			rate:     groupRate,
+		})
+	}
+	return rows, nil
 }
 
-func (t *Transaction) validate() error {
-	switch t.TransactionType {
-	case txBuyGold, txSellGold, txCardSpend:
-	default:
-		return fmt.Errorf("unknown transaction type: %s", t.TransactionType)
+// tieBreak reports whether a ranks before b when they spent the same, so
+// that reports are reproducible: the user with more transactions first, then
+// by email.
+func tieBreak(a, b *UserMonthlySpending) bool {
+	if a.TransactionCount != b.TransactionCount {
+		return a.TransactionCount > b.TransactionCount
 	}
+	return a.Email < b.Email
+}
 
-	switch t.FromCurrency {
-	case currencyGBP, currencyGGM:
-	default:
-		return fmt.Errorf("unsupported currency")
+// percentileRows returns a row per percentile of the total spend of all the
+// users of the month, labelled like p50 for the 0.5 percentile.
+func percentileRows(key int, month map[string]*UserMonthlySpending, cfg Config) []*reportRow {
+	currency, rate := cfg.outputCurrency()
+	totals := make([]float64, 0, len(month))
+	for _, us := range month {
+		totals = append(totals, us.TotalGBP.Float64())
 	}
+	sort.Float64s(totals)
 
-	switch t.ToCurrency {
-	case currencyGBP, currencyGGM:
-	default:
-		return fmt.Errorf("unsupported currency")
+	rows := make([]*reportRow, 0, len(cfg.IncludePercentiles))
+	for _, p := range cfg.IncludePercentiles {
+		// Rounded to float32 so that e.g. 0.07 reads p7, not p7.000000000000001.
+		label := "p" + strconv.FormatFloat(p*100, 'f', -1, 32)
+		rows = append(rows, &reportRow{
+			month:    key,
+			label:    label,
+			spending: &UserMonthlySpending{TotalGBP: DecimalFromFloat(percentile(totals, p))},
+			currency: currency,
+			rate:     rate,
+		})
 	}
+	return rows
+}
 
-	return nil
+// totalRow returns the row summing the spend of all the users of the month.
+func totalRow(key int, month map[string]*UserMonthlySpending, cfg Config) *reportRow {
+	currency, rate := cfg.outputCurrency()
+	total := &UserMonthlySpending{}
+	for _, us := range month {
+		total.merge(us)
+	}
+	total.Email, total.FirstName, total.LastName = totalLabel, "", ""
+	return &reportRow{
+		month:    key,
+		label:    totalLabel,
+		spending: total,
+		currency: currency,
+		rate:     rate,
+	}
 }
 
-type UserMonthlySpending struct {
-	FirstName        string
-	LastName         string
-	Email            string
-	TotalGBP         float64
-	TransactionCount int
+// rankedTotalRow returns the row summing the spend of the users of rows.
+func rankedTotalRow(key int, rows []*reportRow, cfg Config) *reportRow {
+	currency, rate := cfg.outputCurrency()
+	total := &UserMonthlySpending{}
+	for _, row := range rows {
+		if !row.synthetic() {
+			total.merge(row.spending)
+		}
+	}
+	total.Email, total.FirstName, total.LastName = rankedTotalLabel, "", ""
+	return &reportRow{
+		month:    key,
+		label:    rankedTotalLabel,
+		spending: total,
+		currency: currency,
+		rate:     rate,
+	}
 }
 
-func (us *UserMonthlySpending) update(tx *Transaction) {
-	// We track spending in GBP: marketing purposes.
-	if tx.FromCurrency == currencyGGM {
-		us.TotalGBP += tx.Amount * tx.Rate
+// percentile returns the p percentile of the sorted values, interpolating
+// linearly between the closest ranks, e.g. the median of 1,2,3,4 is 2.5.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := p * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	if lower < 0 {
+		return sorted[0]
 	}
+	return sorted[lower] + (pos-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// countPercentile returns the percentage of the sorted counts at or below
+// count, so that users with the same count share a percentile and the most
+// frequent users are at 100.
+func countPercentile(counts []int, count int) float64 {
+	atOrBelow := sort.SearchInts(counts, count+1)
+	return 100 * float64(atOrBelow) / float64(len(counts))
+}
+
+// countRank returns the rank of count among the sorted counts, highest
+// first, where equal counts share the rank.
+func countRank(counts []int, count int) int {
+	above := len(counts) - sort.SearchInts(counts, count+1)
+	return above + 1
+}
 
-	if tx.FromCurrency == currencyGBP {
-		us.TotalGBP += tx.Amount
+// growth returns the spend growth of every user in month key compared to the
+// previous calendar month. Users new in the month grow by their full spend.
+func growth(aggregates *aggregator, key int, month map[string]*UserMonthlySpending, cfg Config) (map[string]float64, error) {
+	previous, err := rankedMonth(aggregates, cfg.prevPeriodKey(key), cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	us.TransactionCount++
+	scores := make(map[string]float64, len(month))
+	for userKey, us := range month {
+		grown := us.TotalGBP
+		if prev, ok := previous[userKey]; ok {
+			grown -= prev.TotalGBP
+		}
+		scores[userKey] = grown.Float64()
+	}
+	return scores, nil
 }
 
-type Config struct {
-	StopOnError bool
+// keepConsistentSpenders drops the rows of users who are not ranked in every
+// month, along with the synthetic rows.
+func keepConsistentSpenders(rankings []*monthRanking) []*monthRanking {
+	monthsRanked := map[string]int{}
+	for _, ranking := range rankings {
+		for _, row := range ranking.rows {
+			if !row.synthetic() {
+				monthsRanked[row.spending.key()]++
+			}
+		}
+	}
+
+	for _, ranking := range rankings {
+		rows := ranking.rows[:0]
+		for _, row := range ranking.rows {
+			if !row.synthetic() && monthsRanked[row.spending.key()] == len(rankings) {
+				rows = append(rows, row)
+			}
+		}
+		ranking.rows = rows
+	}
+	return rankings
 }
 
-type parsedTx struct {
-	tx  *Transaction
-	err error
+func writeMonthlySpendings(aggregates *aggregator, w io.Writer, cfg Config) error {
+	rankings, err := rankMonths(aggregates, cfg)
+	if err != nil {
+		return err
+	}
+	return writeRankings(aggregates, rankings, w, cfg)
 }
 
-// TopSpenders processes a CSV of transactions and writes the top 5 spenders per month.
-func TopSpenders(transactionsList io.Reader, results io.Writer, cfg Config) error {
-	// Streaming on channels allows us not to fit he entire list in memory.
-	transactions := newTxStream(transactionsList)
+// writeResults writes the rankings to the results writer, compressed when
+// Config.GzipOutput is set.
+func writeResults(aggregates *aggregator, rankings []*monthRanking, results io.Writer, cfg Config) error {
+	if !cfg.GzipOutput {
+		return writeRankings(aggregates, rankings, results, cfg)
+	}
+	// Nothing at all means no gzip stream either, which would not be empty.
+	if cfg.EmptyResultBehavior == NoOutput && isEmpty(rankings) {
+		return nil
+	}
 
-	// yearmonth:email:spending
-	monthlySpendings := map[int]map[string]*UserMonthlySpending{}
+	gz := gzip.NewWriter(results)
+	if err := writeRankings(aggregates, rankings, gz, cfg); err != nil {
+		return fmt.Errorf("writing gzip output: %w", err)
+	}
+	// Close writes the last compressed block, a failure loses the output.
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("closing gzip output: %w", err)
+	}
+	return nil
+}
 
-	// We write responses sorted by date.
-	// May remove if undesired.
-	for parsed := range transactions {
-		if parsed.err != nil {
-			if cfg.StopOnError {
-				return parsed.err
+// writeOutputTargets writes the rankings to every Config.OutputTargets,
+// keeping the rows each target's filter accepts.
+func writeOutputTargets(aggregates *aggregator, rankings []*monthRanking, cfg Config) error {
+	for i, target := range cfg.OutputTargets {
+		filtered := rankings
+		if target.Filter != nil {
+			filtered = make([]*monthRanking, 0, len(rankings))
+			for _, ranking := range rankings {
+				kept := &monthRanking{month: ranking.month}
+				for _, row := range ranking.rows {
+					if target.Filter(newRow(row, cfg)) {
+						kept.rows = append(kept.rows, row)
+					}
+				}
+				filtered = append(filtered, kept)
 			}
-			// TODO: find a neater solution to separate the error from the output
-			// not everyone separates stdout from stderr
-			slog.Error("input error", "error", parsed.err)
-			continue
 		}
 
-		tx := parsed.tx
-		if tx.TransactionType != txCardSpend {
-			// We are only interested in 'CARD SPEND' transactions.
-			continue
+		targetCfg := cfg
+		targetCfg.OutputFormat = target.Format
+		targetCfg.OutputTemplate = nil
+		if err := writeRankings(aggregates, filtered, target.Writer, targetCfg); err != nil {
+			return fmt.Errorf("writing output target %d: %w", i, err)
 		}
-		key := monthKey(tx.Date)
-		// Initialise the nested map if it is an unseen month
-		month, ok := monthlySpendings[key]
-		if !ok {
-			month = map[string]*UserMonthlySpending{}
-			monthlySpendings[key] = month
+	}
+	return nil
+}
+
+// writeRankings writes the report of rankings in the format selected in cfg.
+func writeRankings(aggregates *aggregator, rankings []*monthRanking, w io.Writer, cfg Config) error {
+	if isEmpty(rankings) {
+		switch cfg.EmptyResultBehavior {
+		case NoOutput:
+			return nil
+		case ErrorOnEmpty:
+			return ErrEmptyResult
 		}
+	}
 
-		userSpendings, ok := month[tx.Email]
-		if !ok {
-			userSpendings = &UserMonthlySpending{
-				FirstName: tx.FirstName,
-				LastName:  tx.LastName,
-				Email:     tx.Email,
-			}
-			month[tx.Email] = userSpendings
+	if cfg.OutputChurn {
+		return writeChurn(rankings, w, cfg)
+	}
+	if cfg.Histogram {
+		return writeHistogram(aggregates, w, cfg)
+	}
+	if cfg.MonthOrder == MonthOrderDesc {
+		// Churn compares each month with the one before, so the rankings
+		// are only reordered for writing.
+		rankings = slices.Clone(rankings)
+		slices.Reverse(rankings)
+	}
+	if cfg.OutputTemplate != nil {
+		return writeTemplate(rankings, w, cfg)
+	}
+	switch cfg.OutputFormat {
+	case OutputFormatJSON:
+		return writeJSON(rankings, w, cfg)
+	case OutputFormatJSONNested:
+		return writeJSONNested(rankings, w, cfg)
+	case OutputFormatMonthSummaryJSONL:
+		return writeMonthSummaries(aggregates, rankings, w, cfg)
+	case OutputFormatMatrix:
+		return writeMatrix(aggregates, w, cfg)
+	}
+
+	columns, err := outputColumns(cfg)
+	if err != nil {
+		return err
+	}
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.name
+	}
+
+	if cfg.IncludeSchemaComment {
+		schema := make([]string, len(columns))
+		for i, c := range columns {
+			schema[i] = c.name + ":" + c.typ
+		}
+		if _, err := io.WriteString(w, "# "+strings.Join(schema, ", ")+cfg.lineEnd()); err != nil {
+			return err
 		}
-		userSpendings.update(tx)
 	}
 
-	return writeMonthlySpendings(monthlySpendings, results)
+	csvWriter := newCSVWriter(w, cfg)
+	csvWriter.Write(header)
+	for _, ranking := range rankings {
+		for _, row := range ranking.rows {
+			record := make([]string, len(columns))
+			for i, c := range columns {
+				record[i] = c.value(row)
+			}
+			if err := csvWriter.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
 }
 
-func writeMonthlySpendings(spendings map[int]map[string]*UserMonthlySpending, w io.Writer) error {
-	monthsSeen := make([]int, 0, len(spendings))
-	for m := range spendings {
-		monthsSeen = append(monthsSeen, m)
+func isEmpty(rankings []*monthRanking) bool {
+	for _, ranking := range rankings {
+		if len(ranking.rows) > 0 {
+			return false
+		}
 	}
-	sort.Ints(monthsSeen)
+	return true
+}
 
-	csvWriter := csv.NewWriter(w)
+// writeChurn writes, for every month but the first, the users who entered
+// and exited the ranking compared to the previous month.
+func writeChurn(rankings []*monthRanking, w io.Writer, cfg Config) error {
+	csvWriter := newCSVWriter(w, cfg)
 	csvWriter.Write([]string{
 		"date",
-		"rank",
-		"amount",
-		"currency",
-		"transactions",
+		"change",
 		"email",
 		"firstName",
 		"lastName",
 	})
-	for _, key := range monthsSeen {
-		month := spendings[key]
-		userSpendings := make([]*UserMonthlySpending, 0, len(month))
-		for _, spendings := range month {
-			userSpendings = append(userSpendings, spendings)
-		}
-		sort.Slice(userSpendings, func(i int, j int) bool {
-			// sort descending by TotalGBP
-			return userSpendings[i].TotalGBP > userSpendings[j].TotalGBP
-		})
+	for i := 1; i < len(rankings); i++ {
+		previous, current := rankings[i-1], rankings[i]
+		changes := []struct {
+			change   string
+			rows     []*reportRow
+			compared []*reportRow
+		}{
+			{"entered", current.rows, previous.rows},
+			{"exited", previous.rows, current.rows},
+		}
 
-		topN := 5
-		if len(userSpendings) < topN {
-			topN = len(userSpendings)
+		for _, c := range changes {
+			compared := map[string]bool{}
+			for _, row := range c.compared {
+				compared[row.spending.key()] = true
+			}
+			for _, row := range c.rows {
+				if row.synthetic() || compared[row.spending.key()] {
+					continue
+				}
+				err := csvWriter.Write([]string{
+					cfg.periodLabel(current.month),
+					c.change,
+					row.spending.Email,
+					row.spending.FirstName,
+					row.spending.LastName,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// defaultHistogramBucketGBP is the bucket width used when
+// Config.HistogramBucketGBP is not set.
+const defaultHistogramBucketGBP = 100
+
+// writeHistogram writes, for every month, the number of users whose total
+// spend falls in each bucket, leaving out empty buckets.
+func writeHistogram(aggregates *aggregator, w io.Writer, cfg Config) error {
+	width := cfg.HistogramBucketGBP
+	if width <= 0 {
+		width = defaultHistogramBucketGBP
+	}
+
+	csvWriter := newCSVWriter(w, cfg)
+	csvWriter.Write([]string{
+		"date",
+		"fromGBP",
+		"toGBP",
+		"count",
+	})
+	keys := aggregates.monthKeys()
+	if cfg.MonthOrder == MonthOrderDesc {
+		slices.Reverse(keys)
+	}
+	for _, key := range keys {
+		month, err := aggregates.month(key)
+		if err != nil {
+			return err
+		}
+
+		counts := map[int]int{}
+		for _, us := range month {
+			counts[int(math.Floor(us.TotalGBP.Float64()/width))]++
+		}
+		buckets := make([]int, 0, len(counts))
+		for bucket := range counts {
+			buckets = append(buckets, bucket)
 		}
-		for i := 0; i < topN; i++ {
-			userSpending := userSpendings[i]
-			rank := i + 1
-			date := time.Date(key/100, time.Month(key%100), 1, 0, 0, 0, 0, time.UTC)
+		sort.Ints(buckets)
+
+		for _, bucket := range buckets {
 			err := csvWriter.Write([]string{
-				date.Format("2006/01"),
-				strconv.Itoa(rank),
-				strconv.FormatFloat(userSpending.TotalGBP, 'f', currencyPrecisionDecimals, 64),
-				"GBP",
-				strconv.Itoa(userSpending.TransactionCount),
-				userSpending.Email,
-				userSpending.FirstName,
-				userSpending.LastName,
+				cfg.periodLabel(key),
+				formatAmount(float64(bucket) * width),
+				formatAmount(float64(bucket+1) * width),
+				strconv.Itoa(counts[bucket]),
 			})
 			if err != nil {
 				return err
@@ -194,87 +2531,389 @@ func writeMonthlySpendings(spendings map[int]map[string]*UserMonthlySpending, w
 	return csvWriter.Error()
 }
 
+// writeMatrix writes the total spend of every user in every month seen,
+// holding a row per user in memory. Totals are capped and converted to the
+// output currency like in the ranking.
+func writeMatrix(aggregates *aggregator, w io.Writer, cfg Config) error {
+	keys := aggregates.monthKeys()
+	totals := map[string][]Decimal{}
+	spent := map[string][]bool{}
+	for i, key := range keys {
+		month, err := rankedMonth(aggregates, key, cfg)
+		if err != nil {
+			return err
+		}
+		for _, us := range month {
+			if _, ok := totals[us.Email]; !ok {
+				totals[us.Email] = make([]Decimal, len(keys))
+				spent[us.Email] = make([]bool, len(keys))
+			}
+			// Categories of the same user add up.
+			totals[us.Email][i] += us.TotalGBP
+			spent[us.Email][i] = true
+		}
+	}
+
+	emails := make([]string, 0, len(totals))
+	for email := range totals {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	header := make([]string, 0, len(keys)+1)
+	header = append(header, "email")
+	for _, key := range keys {
+		header = append(header, cfg.periodLabel(key))
+	}
+
+	_, rate := cfg.outputCurrency()
+	csvWriter := newCSVWriter(w, cfg)
+	csvWriter.Write(header)
+	for _, email := range emails {
+		record := make([]string, 0, len(keys)+1)
+		record = append(record, email)
+		for i, total := range totals[email] {
+			if !spent[email][i] && !cfg.MatrixZeroFill {
+				record = append(record, "")
+				continue
+			}
+			if rate != 1 {
+				record = append(record, formatAmount(total.Float64()*rate))
+				continue
+			}
+			record = append(record, total.String())
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// movingAverage returns the user's average spend over the trailing
+// cfg.MovingAverageMonths calendar months ending with month key.
+func movingAverage(aggregates *aggregator, key int, userKey string, cfg Config) (float64, error) {
+	var total Decimal
+	monthsCounted := 0
+	for i := 0; i < cfg.MovingAverageMonths; i++ {
+		month, err := aggregates.month(key)
+		if err != nil {
+			return 0, err
+		}
+		if us, ok := month[userKey]; ok {
+			total += us.TotalGBP
+			monthsCounted++
+		} else if !cfg.MovingAverageSkipGaps {
+			// Missing months count as zero spend.
+			monthsCounted++
+		}
+		key = cfg.prevPeriodKey(key)
+	}
+
+	if monthsCounted == 0 {
+		return 0, nil
+	}
+	return total.Float64() / float64(monthsCounted), nil
+}
+
 // monthKey creates a sortable integer key from a date, e.g., 2024/07 -> 202407.
 func monthKey(date time.Time) int {
 	return date.Year()*100 + int(date.Month())
 }
 
-func newTxStream(transactionsList io.Reader) chan parsedTx {
+// sparklineMonths is the length of the series in the sparkline column.
+const sparklineMonths = 12
+
+// sparkline returns the user's spend in the sparklineMonths calendar months
+// ending with month key, oldest first. Months without spend are zero.
+func sparkline(aggregates *aggregator, key int, userKey string, cfg Config) ([]float64, error) {
+	series := make([]float64, sparklineMonths)
+	for i := len(series) - 1; i >= 0; i-- {
+		month, err := aggregates.month(key)
+		if err != nil {
+			return nil, err
+		}
+		if us, ok := month[userKey]; ok {
+			series[i] = us.TotalGBP.Float64()
+		}
+		key = cfg.prevPeriodKey(key)
+	}
+	return series, nil
+}
+
+// prevMonthKey returns the key of the calendar month preceding key.
+func prevMonthKey(key int) int {
+	if key%100 == 1 {
+		return (key/100-1)*100 + 12
+	}
+	return key - 1
+}
+
+// monthLabel formats a month key for output, e.g., 202407 -> 2024/07.
+func monthLabel(key int) string {
+	date := time.Date(key/100, time.Month(key%100), 1, 0, 0, 0, 0, time.UTC)
+	return date.Format("2006/01")
+}
+
+// newTxStream decodes the transactions of the input on a channel, which is
+// closed at the end of the input or once ctx is done.
+func newTxStream(ctx context.Context, transactionsList io.Reader, cfg Config) chan parsedTx {
 	csvReader := csv.NewReader(transactionsList)
+	if cfg.Delimiter != 0 {
+		csvReader.Comma = cfg.Delimiter
+	}
 	txChan := make(chan parsedTx, 1)
 
 	go func() {
+		defer close(txChan)
 
-		// skip input headers
-		// TODO: check if there are headers at all
-		if _, err := csvReader.Read(); err != nil {
-			txChan <- parsedTx{err: err}
-			close(txChan)
+		// send reports whether the consumer is still reading.
+		send := func(parsed parsedTx) bool {
+			select {
+			case txChan <- parsed:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		headerReader := csvReader
+		if cfg.HeaderSource != nil {
+			headerReader = csv.NewReader(cfg.HeaderSource)
+			headerReader.Comma = csvReader.Comma
+		}
+		header, err := headerReader.Read()
+		if err != nil {
+			send(parsedTx{err: fmt.Errorf("reading header: %w", err)})
 			return
 		}
+		// first holds the first data row when the input starts without a
+		// header, to be read before the rest of the input.
+		var first []string
+		var firstLine int
+		// A row to verify is the header, whether it looks like one or not.
+		if cfg.HeaderSource == nil && !cfg.VerifyHeader && !isHeader(header) {
+			first, header = header, inputHeader
+			firstLine, _ = csvReader.FieldPos(0)
+		}
+		// next returns the next data row and the line it starts on.
+		next := func() ([]string, int, error) {
+			if first != nil {
+				record, line := first, firstLine
+				first = nil
+				return record, line, nil
+			}
+			record, err := csvReader.Read()
+			if err != nil {
+				return record, 0, err
+			}
+			line, _ := csvReader.FieldPos(0)
+			return record, line, nil
+		}
+		if cfg.VerifyHeader {
+			if err := verifyHeader(header); err != nil {
+				send(parsedTx{err: err, fatal: true})
+				return
+			}
+		}
+		if cfg.DedupeByID && cfg.IDHeader != "" {
+			cfg.IDColumn = slices.Index(header, cfg.IDHeader)
+			if cfg.IDColumn < 0 {
+				send(parsedTx{err: fmt.Errorf("id column not in header: %s", cfg.IDHeader), fatal: true})
+				return
+			}
+		}
+
+		for skipped := 0; skipped < cfg.SkipFirstRows; skipped++ {
+			if _, _, err := next(); err != nil {
+				if !errors.Is(err, io.EOF) {
+					send(parsedTx{err: err})
+				}
+				return
+			}
+		}
 
 		for {
-			record, err := csvReader.Read()
+			record, line, err := next()
 			if err != nil {
 				if !errors.Is(err, io.EOF) {
 					// If we're not finished with the input yet, return the error.
-					txChan <- parsedTx{err: err}
+					parsed := parsedTx{err: err, record: record}
+					if parseErr := (*csv.ParseError)(nil); errors.As(err, &parseErr) {
+						parsed.line = parseErr.StartLine
+					}
+					send(parsed)
 				}
 				// io.EOF signals that we reached the end of the input
-				close(txChan)
 				return
 			}
 
-			tx, err := decodeRecord(record)
+			tx, err := decodeRecord(record, &cfg)
 			if err != nil {
 				// Caller may decide whether to stop the whole process
 				// when input errors are detected.
 				// For now, we continue.
-				txChan <- parsedTx{err: err}
+				if !send(parsedTx{err: err, record: record, line: line}) {
+					return
+				}
 				continue
 			}
 
-			if err := tx.validate(); err != nil {
-				txChan <- parsedTx{err: err}
+			if err := tx.validate(&cfg); err != nil {
+				if !send(parsedTx{err: err, record: record, line: line}) {
+					return
+				}
 				continue
 			}
 
-			txChan <- parsedTx{tx: tx}
+			if !send(parsedTx{tx: tx, record: record, line: line}) {
+				return
+			}
 		}
 	}()
 
 	return txChan
 }
 
-func decodeRecord(record []string) (*Transaction, error) {
+// checkIDColumn checks that DedupeByID knows where to read the ids from.
+func checkIDColumn(cfg Config) error {
+	if !cfg.DedupeByID || cfg.IDHeader != "" {
+		return nil
+	}
+	if cfg.IDColumn <= 0 {
+		return fmt.Errorf("dedupe by id needs an id column or header, got column %d", cfg.IDColumn)
+	}
+	return nil
+}
+
+// checkDelimiter checks that delimiter can separate the fields of the input,
+// where zero stands for the default comma.
+func checkDelimiter(delimiter rune) error {
+	switch delimiter {
+	case 0:
+		return nil
+	case '\r', '\n', '"', utf8.RuneError:
+		return fmt.Errorf("invalid delimiter: %q", delimiter)
+	}
+	if !utf8.ValidRune(delimiter) {
+		return fmt.Errorf("invalid delimiter: %q", delimiter)
+	}
+	return nil
+}
+
+// isHeader reports whether record is a header row rather than data, i.e.
+// whether it names any of the input columns, ignoring case.
+func isHeader(record []string) bool {
+	for _, field := range record {
+		for _, name := range inputHeader {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyHeader checks that header starts with the input columns.
+func verifyHeader(header []string) error {
+	if l := len(header); l < len(inputHeader) {
+		return fmt.Errorf("unexpected header: %v < %v columns", l, len(inputHeader))
+	}
+	for i, name := range inputHeader {
+		if header[i] != name {
+			return fmt.Errorf("unexpected header: column %d is %q, expected %q", i+1, header[i], name)
+		}
+	}
+	return nil
+}
+
+func decodeRecord(record []string, cfg *Config) (*Transaction, error) {
 	if l := len(record); l < 10 {
 		return nil, fmt.Errorf("invalid number of columns: %v < 10", l)
 	}
 
+	if cfg.IntegerAmountsOnly {
+		if _, err := strconv.ParseInt(record[5], 10, 64); err != nil {
+			return nil, fmt.Errorf("non-integer amount: %s", record[5])
+		}
+		// An empty rate is read as zero, like without IntegerAmountsOnly.
+		if _, err := strconv.ParseInt(record[8], 10, 64); err != nil && record[8] != "" {
+			return nil, fmt.Errorf("non-integer rate: %s", record[8])
+		}
+	}
+
 	amount, err := strconv.ParseFloat(record[5], 64)
 	if err != nil {
 		return nil, err
 	}
-	rate, err := strconv.ParseFloat(record[8], 64)
+	// The rate is redundant for base currency rows, so it may be left empty.
+	// validate ensures it is present where a conversion needs it.
+	var rate float64
+	if record[8] != "" {
+		rate, err = strconv.ParseFloat(record[8], 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dateValue := record[9]
+	if cfg.SeparateDateTime {
+		dateColumn, timeColumn := cfg.dateTimeColumns()
+		if l := len(record); l <= max(dateColumn, timeColumn) {
+			return nil, fmt.Errorf("invalid number of columns: %v <= %v", l, max(dateColumn, timeColumn))
+		}
+		dateValue = record[dateColumn] + " " + record[timeColumn]
+	}
+	date, err := parseDate(dateValue, cfg.dateLayouts())
 	if err != nil {
 		return nil, err
 	}
 
-	date, err := time.Parse(timeLayout, record[9])
-	if err != nil {
-		return nil, fmt.Errorf("invalid time format: %s", record[9])
+	var id string
+	if cfg.DedupeByID {
+		if l := len(record); l <= cfg.IDColumn {
+			return nil, fmt.Errorf("invalid number of columns: %v <= %v", l, cfg.IDColumn)
+		}
+		id = record[cfg.IDColumn]
+	}
+
+	fromCurrency, toCurrency := record[6], record[7]
+	if fromCurrency == "" {
+		fromCurrency = cfg.DefaultCurrency
+	}
+	if toCurrency == "" {
+		toCurrency = cfg.DefaultCurrency
 	}
 
-	return &Transaction{
-		FirstName:       record[0],
-		LastName:        record[1],
+	var tx *Transaction
+	if cfg.ReuseTransactions {
+		tx = txPool.Get().(*Transaction)
+	} else {
+		tx = new(Transaction)
+	}
+	*tx = Transaction{
+		FirstName:       strings.TrimSpace(record[0]),
+		LastName:        strings.TrimSpace(record[1]),
 		Email:           record[2],
 		TransactionType: record[3],
 		MerchantCode:    record[4],
 		Amount:          amount,
-		FromCurrency:    record[6],
-		ToCurrency:      record[7],
+		FromCurrency:    fromCurrency,
+		ToCurrency:      toCurrency,
 		Rate:            rate,
 		Date:            date,
-	}, nil
+		ID:              id,
+	}
+	return tx, nil
+}
+
+// parseDate parses value with the first of layouts that matches.
+func parseDate(value string, layouts []string) (time.Time, error) {
+	for _, layout := range layouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time format: %s", value)
 }
@@ -2,9 +2,19 @@ package parse
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
+	"text/template"
 	"time"
 )
 
@@ -84,42 +94,3303 @@ C,C,c@test.com,CARD SPEND,5013,200,GBP,GBP,1,12/01/2024 12:00
 		if err == nil {
 			t.Fatal("expected an error but got nil")
 		}
+		if !strings.HasPrefix(err.Error(), "line 3: ") {
+			t.Errorf("expected the error to name line 3, got %v", err)
+		}
+
+		// Processing should stop on the first error, the output-writing function should never be called.
+		if outBuffer.Len() > 0 {
+			t.Errorf("expected empty output, but got: %s", outBuffer.String())
+		}
+	})
+
+	t.Run("continues on error when flag is not set", func(t *testing.T) {
+		t.Parallel()
+		// Use the same malformed input as the previous test.
+		csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
+C,C,c@test.com,CARD SPEND,5013,200,GBP,GBP,1,12/01/2024 12:00
+`
+		inBuffer := bytes.NewBufferString(csvInput)
+		outBuffer := &bytes.Buffer{}
+
+		cfg := Config{StopOnError: false}
+		err := TopSpenders(inBuffer, outBuffer, cfg)
+
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+
+		// The program should skip the invalid row and produce output for the valid ones.
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,c@test.com,C,C
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+`
+		if outBuffer.String() != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+		}
+	})
+}
+
+func TestTopSpenders_movingAverage(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 500, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)},
+		// B skips February.
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 40, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 80, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 3, 11, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "gaps count as zero",
+			cfg:  Config{MovingAverageMonths: 2},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName,movingAvgGBP
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A,50.0000000
+2024/01,2,40.0000000,GBP,1,b@test.com,B,B,20.0000000
+2024/02,1,300.0000000,GBP,1,a@test.com,A,A,200.0000000
+2024/03,1,500.0000000,GBP,1,a@test.com,A,A,400.0000000
+2024/03,2,80.0000000,GBP,1,b@test.com,B,B,40.0000000
+`,
+		},
+		{
+			name: "gaps skipped",
+			cfg:  Config{MovingAverageMonths: 2, MovingAverageSkipGaps: true},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName,movingAvgGBP
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A,100.0000000
+2024/01,2,40.0000000,GBP,1,b@test.com,B,B,40.0000000
+2024/02,1,300.0000000,GBP,1,a@test.com,A,A,200.0000000
+2024/03,1,500.0000000,GBP,1,a@test.com,A,A,400.0000000
+2024/03,2,80.0000000,GBP,1,b@test.com,B,B,80.0000000
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_skipFirstRows(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,1000,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,12/01/2024 12:00
+C,C,c@test.com,CARD SPEND,5013,200,GBP,GBP,1,13/01/2024 12:00
+`
+	outBuffer := &bytes.Buffer{}
+	err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, Config{StopOnError: true, SkipFirstRows: 2})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// The skipped rows must neither fail the run nor contribute to the totals.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,c@test.com,C,C
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+`
+	if outBuffer.String() != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+	}
+}
+
+func TestTopSpenders_onlyConsistentSpenders(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 500, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+2024/02,1,300.0000000,GBP,1,a@test.com,A,A
+`
+	output, err := runTest(t, transactions, Config{OnlyConsistentSpenders: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_outputChurn(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	// Five January spenders fill the ranking.
+	for i, email := range []string{"a", "b", "c", "d", "e"} {
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: float64(100 * (i + 1)), FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	// In February F outspends everyone, pushing A out of the top 5.
+	for i, email := range []string{"a", "b", "c", "d", "e"} {
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: float64(100 * (i + 1)), FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	transactions = append(transactions, &Transaction{FirstName: "f", LastName: "f", Email: "f@test.com", TransactionType: txCardSpend, Amount: 1000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)})
+
+	expectedCSV := `date,change,email,firstName,lastName
+2024/02,entered,f@test.com,f,f
+2024/02,exited,a@test.com,a,a
+`
+	output, err := runTest(t, transactions, Config{OutputChurn: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_exactAmountStrings(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i := 0; i < 10; i++ {
+		transactions = append(transactions, &Transaction{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 0.1, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	transactions = append(transactions, &Transaction{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 0.125, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 0.3, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)})
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,1.0,GBP,10,a@test.com,A,A
+2024/01,2,0.0375,GBP,1,b@test.com,B,B
+`
+	output, err := runTest(t, transactions, Config{ExactAmountStrings: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_errorLineNumbers(t *testing.T) {
+	t.Parallel()
+	header := "First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date\n"
+	valid := "A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00\n"
+	testCases := []struct {
+		name    string
+		row     string
+		wantErr string
+	}{
+		{
+			name:    "decode error",
+			row:     "B,B,b@test.com,CARD SPEND,5013,100,GBP,GBP,1,2024-01-11\n",
+			wantErr: "line 4: invalid time format: 2024-01-11",
+		},
+		{
+			name:    "validation error",
+			row:     "B,B,b@test.com,CARD SPEND,5013,100,USD,GBP,1,11/01/2024 12:00\n",
+			wantErr: "line 4: unsupported currency: USD",
+		},
+		{
+			name:    "column count error",
+			row:     "B,B,b@test.com,CARD SPEND,5013,100\n",
+			wantErr: "record on line 4: wrong number of fields",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			csvInput := header + valid + valid + tc.row + valid
+			err := TopSpenders(bytes.NewBufferString(csvInput), &bytes.Buffer{}, Config{StopOnError: true})
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_headerDetection(t *testing.T) {
+	t.Parallel()
+	data := `A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00
+A,A,a@test.com,CARD SPEND,5013,150,GBP,GBP,1,12/01/2024 12:00
+`
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,250.0000000,GBP,2,a@test.com,A,A
+2024/01,2,200.0000000,GBP,1,b@test.com,B,B
+`
+
+	testCases := []struct {
+		name   string
+		header string
+	}{
+		{
+			name:   "header",
+			header: "First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date\n",
+		},
+		{
+			name:   "header in another case",
+			header: "FIRST NAME,LAST NAME,EMAIL,DESCRIPTION,MERCHANT CODE,AMOUNT,FROM CURRENCY,TO CURRENCY,RATE,DATE\n",
+		},
+		{
+			name: "no header",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outBuffer := &bytes.Buffer{}
+			err := TopSpenders(bytes.NewBufferString(tc.header+data), outBuffer, Config{StopOnError: true})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if outBuffer.String() != expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_delimiter(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00
+"C, Jr",C,c@test.com,CARD SPEND,5013,2,GGM,GBP,60,12/01/2024 12:00
+`
+	expected := &bytes.Buffer{}
+	if err := TopSpenders(bytes.NewBufferString(csvInput), expected, Config{StopOnError: true}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		delimiter rune
+	}{
+		{name: "semicolon", delimiter: ';'},
+		{name: "tab", delimiter: '\t'},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input := strings.ReplaceAll(csvInput, ",", string(tc.delimiter))
+			input = strings.ReplaceAll(input, "C"+string(tc.delimiter)+" Jr", "C, Jr")
+			outBuffer := &bytes.Buffer{}
+			if err := TopSpenders(strings.NewReader(input), outBuffer, Config{StopOnError: true, Delimiter: tc.delimiter}); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if outBuffer.String() != expected.String() {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expected.String())
+			}
+		})
+	}
+
+	t.Run("invalid delimiter", func(t *testing.T) {
+		err := TopSpenders(strings.NewReader(csvInput), &bytes.Buffer{}, Config{Delimiter: '"'})
+		if err == nil || err.Error() != `invalid delimiter: '"'` {
+			t.Fatalf("expected an invalid delimiter error, got %v", err)
+		}
+	})
+}
+
+func TestTopSpenders_optionalRate(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		csvInput string
+		wantErr  bool
+	}{
+		{
+			name: "base currency row with empty rate is accepted",
+			csvInput: `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,,10/01/2024 12:00
+`,
+			wantErr: false,
+		},
+		{
+			name: "gold row with empty rate is rejected",
+			csvInput: `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,2,GGM,GBP,,10/01/2024 12:00
+`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outBuffer := &bytes.Buffer{}
+			err := TopSpenders(bytes.NewBufferString(tc.csvInput), outBuffer, Config{StopOnError: true})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("TopSpenders() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_rates(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,2,GGM,GBP,,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,2,GGM,GBP,60,11/01/2024 12:00
+C,C,c@test.com,CARD SPEND,5013,50,GBP,GBP,,12/01/2024 12:00
+`
+
+	t.Run("rows without a rate use the table", func(t *testing.T) {
+		outBuffer := &bytes.Buffer{}
+		cfg := Config{StopOnError: true, Rates: map[string]float64{"GGM:GBP": 50}}
+		if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, cfg); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,120.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+2024/01,3,50.0000000,GBP,1,c@test.com,C,C
+`
+		if outBuffer.String() != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+		}
+	})
+
+	t.Run("rows without any rate are rejected", func(t *testing.T) {
+		err := TopSpenders(bytes.NewBufferString(csvInput), &bytes.Buffer{}, Config{StopOnError: true, Rates: map[string]float64{"GGM:USD": 50}})
+		if err == nil || err.Error() != "line 2: missing or invalid rate for GGM: 0" {
+			t.Fatalf("expected a missing rate error, got %v", err)
+		}
+	})
+}
+
+func TestTopSpenders_emptyResultBehavior(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txBuyGold, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGGM, Rate: 50, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		behavior    EmptyResultBehavior
+		expectedCSV string
+		wantErr     error
+	}{
+		{
+			name:        "header only",
+			behavior:    HeaderOnly,
+			expectedCSV: "date,rank,amount,currency,transactions,email,firstName,lastName\n",
+		},
+		{
+			name:        "no output",
+			behavior:    NoOutput,
+			expectedCSV: "",
+		},
+		{
+			name:        "error on empty",
+			behavior:    ErrorOnEmpty,
+			expectedCSV: "",
+			wantErr:     ErrEmptyResult,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, Config{EmptyResultBehavior: tc.behavior})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_rejectsWriter(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
+C,C,c@test.com,CARD SPEND,5013,200,USD,GBP,1,12/01/2024 12:00
+`
+	outBuffer := &bytes.Buffer{}
+	rejectsBuffer := &bytes.Buffer{}
+
+	err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, Config{RejectsWriter: rejectsBuffer})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expectedRejects := `B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00,"line 3: strconv.ParseFloat: parsing ""invalid_amount"": invalid syntax"
+C,C,c@test.com,CARD SPEND,5013,200,USD,GBP,1,12/01/2024 12:00,line 4: unsupported currency: USD
+`
+	if rejectsBuffer.String() != expectedRejects {
+		t.Errorf("rejects do not match expected value.\nGot:\n%s\nExpected:\n%s", rejectsBuffer.String(), expectedRejects)
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`
+	if outBuffer.String() != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+	}
+}
+
+func TestTopSpenders_errorWriter(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
+C,C,c@test.com,CARD SPEND,5013,200,USD,GBP,1,12/01/2024 12:00
+`
+	outBuffer := &bytes.Buffer{}
+	errorBuffer := &bytes.Buffer{}
+	logs := &bytes.Buffer{}
+
+	cfg := Config{
+		ErrorWriter: errorBuffer,
+		Logger:      slog.New(slog.NewTextHandler(logs, nil)),
+	}
+	if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expectedErrors := `{"line":3,"record":["B","B","b@test.com","CARD SPEND","5013","invalid_amount","GBP","GBP","1","11/01/2024 12:00"],"error":"strconv.ParseFloat: parsing \"invalid_amount\": invalid syntax"}
+{"line":4,"record":["C","C","c@test.com","CARD SPEND","5013","200","USD","GBP","1","12/01/2024 12:00"],"error":"unsupported currency: USD"}
+`
+	if errorBuffer.String() != expectedErrors {
+		t.Errorf("skipped rows do not match expected value.\nGot:\n%s\nExpected:\n%s", errorBuffer.String(), expectedErrors)
+	}
+	if logs.Len() > 0 {
+		t.Errorf("expected nothing logged, got: %s", logs.String())
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`
+	if outBuffer.String() != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+	}
+}
+
+func TestTopSpendersMulti(t *testing.T) {
+	t.Parallel()
+	january := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
+`
+	february := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,50,GBP,GBP,1,31/01/2024 12:00
+C,C,c@test.com,CARD SPEND,5013,200,USD,GBP,1,12/02/2024 12:00
+`
+	outBuffer := &bytes.Buffer{}
+	rejectsBuffer := &bytes.Buffer{}
+
+	sources := []Source{
+		{Name: "january.csv", Reader: strings.NewReader(january)},
+		{Name: "february.csv", Reader: strings.NewReader(february)},
+	}
+	if err := TopSpendersMulti(sources, outBuffer, Config{RejectsWriter: rejectsBuffer}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expectedRejects := `B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00,"line 3: strconv.ParseFloat: parsing ""invalid_amount"": invalid syntax",january.csv
+C,C,c@test.com,CARD SPEND,5013,200,USD,GBP,1,12/02/2024 12:00,line 3: unsupported currency: USD,february.csv
+`
+	if rejectsBuffer.String() != expectedRejects {
+		t.Errorf("rejects do not match expected value.\nGot:\n%s\nExpected:\n%s", rejectsBuffer.String(), expectedRejects)
+	}
+
+	// Spending is aggregated across the sources.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,150.0000000,GBP,2,a@test.com,A,A
+`
+	if outBuffer.String() != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+	}
+}
+
+func TestTopSpenders_dateLayouts(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,2024-02-11
+`
+	outBuffer := &bytes.Buffer{}
+	cfg := Config{StopOnError: true, DateLayouts: []string{timeLayout, "2006-01-02"}}
+	if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+2024/02,1,200.0000000,GBP,1,b@test.com,B,B
+`
+	if outBuffer.String() != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+	}
+}
+
+func TestTopSpenders_includeSparkline(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 2.5, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 12, 10, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName,sparkline
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A,"0,0,0,0,0,0,0,0,0,0,0,100"
+2024/05,1,2.5000000,GBP,1,a@test.com,A,A,"0,0,0,0,0,0,0,100,0,0,0,2.5"
+2024/12,1,300.0000000,GBP,1,a@test.com,A,A,"100,0,0,0,2.5,0,0,0,0,0,0,300"
+`
+	output, err := runTest(t, transactions, Config{IncludeSparkline: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_userCurrencyPreference(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+	}
+	preferences := map[string]string{
+		"a@test.com": "EUR",
+		"b@test.com": "USD",
+	}
+
+	cfg := Config{
+		UserCurrencyPreference: func(email string) string { return preferences[email] },
+		DisplayRates:           map[string]float64{"EUR": 1.2, "USD": 1.25},
+	}
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,250.0000000,USD,1,b@test.com,B,B
+2024/01,2,120.0000000,EUR,1,a@test.com,A,A
+2024/01,3,50.0000000,GBP,1,c@test.com,C,C
+`
+	output, err := runTest(t, transactions, cfg)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	t.Run("missing display rate", func(t *testing.T) {
+		cfg := cfg
+		cfg.DisplayRates = nil
+		if _, err := runTest(t, transactions, cfg); err == nil {
+			t.Error("expected an error but got nil")
+		}
+	})
+}
+
+func TestTopSpenders_requireConvertible(t *testing.T) {
+	t.Parallel()
+	t.Run("gold row without a display rate", func(t *testing.T) {
+		csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,2,GGM,GBP,50,10/01/2024 12:00
+`
+		cfg := Config{
+			UserCurrencyPreference: func(string) string { return "USD" },
+			RequireConvertible:     true,
+			StopOnError:            true,
+		}
+		err := TopSpenders(bytes.NewBufferString(csvInput), &bytes.Buffer{}, cfg)
+		if err == nil || err.Error() != "line 2: no display rate for currency USD" {
+			t.Fatalf("expected the row to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("display currency without a rate", func(t *testing.T) {
+		transactions := []*Transaction{
+			{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+			{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		}
+		cfg := Config{
+			UserCurrencyPreference: func(email string) string {
+				if email == "b@test.com" {
+					return "USD"
+				}
+				return ""
+			},
+			RequireConvertible: true,
+		}
+
+		// B can't be shown in USD, so B's transactions are skipped.
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`
+		output, err := runTest(t, transactions, cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+
+		cfg.StopOnError = true
+		if _, err := runTest(t, transactions, cfg); err == nil {
+			t.Error("expected an error but got nil")
+		}
+	})
+}
+
+func TestTopSpenders_requireNames(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+  A  ,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,   ,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00
+`
+
+	t.Run("whitespace-only name is rejected", func(t *testing.T) {
+		err := TopSpenders(bytes.NewBufferString(csvInput), &bytes.Buffer{}, Config{StopOnError: true, RequireNames: true})
+		if err == nil {
+			t.Fatal("expected an error but got nil")
+		}
+	})
+
+	t.Run("names are trimmed and accepted by default", func(t *testing.T) {
+		outBuffer := &bytes.Buffer{}
+		err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, Config{StopOnError: true})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+`
+		if outBuffer.String() != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+		}
+	})
+}
+
+func TestTopSpenders_skipZeroAmount(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 0, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "zero amount counted by default",
+			cfg:  Config{},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,2,a@test.com,A,A
+`,
+		},
+		{
+			name: "zero amount skipped",
+			cfg:  Config{SkipZeroAmount: true},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_byCategory(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, MerchantCode: "5411", Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, MerchantCode: "5411", Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, MerchantCode: "4511", Amount: 900, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, MerchantCode: "9999", Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+	}
+
+	cfg := Config{
+		Aggregation:        AggregationByCategory,
+		MerchantCategories: map[string]string{"5411": "groceries", "4511": "travel"},
+	}
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName,category
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B,groceries
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A,groceries
+2024/01,1,50.0000000,GBP,1,b@test.com,B,B,other
+2024/01,1,900.0000000,GBP,1,a@test.com,A,A,travel
+`
+	output, err := runTest(t, transactions, cfg)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_includeBottomN(t *testing.T) {
+	t.Parallel()
+	newTx := func(email string, amount float64) *Transaction {
+		return &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)}
+	}
+
+	t.Run("top and bottom spenders", func(t *testing.T) {
+		var transactions []*Transaction
+		for i, email := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+			transactions = append(transactions, newTx(email, float64(100*(i+1))))
+		}
+
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName,segment
+2024/01,1,800.0000000,GBP,1,h@test.com,h,h,top
+2024/01,2,700.0000000,GBP,1,g@test.com,g,g,top
+2024/01,3,600.0000000,GBP,1,f@test.com,f,f,top
+2024/01,4,500.0000000,GBP,1,e@test.com,e,e,top
+2024/01,5,400.0000000,GBP,1,d@test.com,d,d,top
+2024/01,6,300.0000000,GBP,1,c@test.com,c,c,bottom
+2024/01,7,200.0000000,GBP,1,b@test.com,b,b,bottom
+2024/01,8,100.0000000,GBP,1,a@test.com,a,a,bottom
+`
+		output, err := runTest(t, transactions, Config{IncludeBottomN: 3})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+
+	t.Run("small month has no duplicates", func(t *testing.T) {
+		transactions := []*Transaction{newTx("a", 100), newTx("b", 200), newTx("c", 300), newTx("d", 400), newTx("e", 500), newTx("f", 600)}
+
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName,segment
+2024/01,1,600.0000000,GBP,1,f@test.com,f,f,top
+2024/01,2,500.0000000,GBP,1,e@test.com,e,e,top
+2024/01,3,400.0000000,GBP,1,d@test.com,d,d,top
+2024/01,4,300.0000000,GBP,1,c@test.com,c,c,top
+2024/01,5,200.0000000,GBP,1,b@test.com,b,b,top
+2024/01,6,100.0000000,GBP,1,a@test.com,a,a,bottom
+`
+		output, err := runTest(t, transactions, Config{IncludeBottomN: 3})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+}
+
+func TestTopSpenders_localeFormat(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "D", LastName: "D", Email: "d@test.com", TransactionType: txCardSpend, Amount: 1234567.891, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "E", LastName: "E", Email: "e@test.com", TransactionType: txCardSpend, Amount: 12.5, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,"1,234,567.89",GBP,1,d@test.com,D,D
+2024/01,2,"2,500.00",GBP,1,c@test.com,C,C
+2024/01,3,12.50,GBP,1,e@test.com,E,E
+`
+	output, err := runTest(t, transactions, Config{LocaleFormat: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_humanAmounts(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)}, // 50*50 = 2500 GBP
+		{FirstName: "D", LastName: "D", Email: "d@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,"£2,500.00",GBP,1,c@test.com,C,C
+2024/01,2,$125.00,USD,1,d@test.com,D,D
+`
+	cfg := Config{
+		HumanAmounts: true,
+		UserCurrencyPreference: func(email string) string {
+			if email == "d@test.com" {
+				return "USD"
+			}
+			return ""
+		},
+		DisplayRates: map[string]float64{"USD": 1.25},
+	}
+	output, err := runTest(t, transactions, cfg)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestFormatHuman(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		amount   float64
+		currency string
+		expected string
+	}{
+		{2500, currencyGBP, "£2,500.00"},
+		{-1234.5, "EUR", "-€1,234.50"},
+		{1000, currencyGGM, "GGM 1,000.00"},
+	}
+
+	for _, tc := range testCases {
+		if got := formatHuman(tc.amount, tc.currency); got != tc.expected {
+			t.Errorf("formatHuman(%v, %s) = %s, expected %s", tc.amount, tc.currency, got, tc.expected)
+		}
+	}
+}
+
+func TestTopSpenders_outputColumns(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `email,date,amount
+b@test.com,2024/01,200.0000000
+a@test.com,2024/01,100.0000000
+`
+	output, err := runTest(t, transactions, Config{OutputColumns: []string{"email", "date", "amount"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	_, err = runTest(t, transactions, Config{OutputColumns: []string{"email", "category"}})
+	if err == nil || err.Error() != "unknown output column: category" {
+		t.Errorf("expected an unknown output column error, got %v", err)
+	}
+}
+
+func TestTopSpenders_includeSchemaComment(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "default columns",
+			cfg:  Config{IncludeSchemaComment: true},
+			expectedCSV: `# date:string, rank:int, amount:float, currency:string, transactions:int, email:string, firstName:string, lastName:string
+date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`,
+		},
+		{
+			name: "selected columns",
+			cfg:  Config{IncludeSchemaComment: true, OutputColumns: []string{"rank", "email", "distinctMerchants"}, IncludeDistinctMerchants: true, IncludeOthersRow: true},
+			expectedCSV: `# rank:string, email:string, distinctMerchants:int
+rank,email,distinctMerchants
+1,a@test.com,1
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_topGrowth(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 5000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 1000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 5100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 500, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName,growthGBP
+2024/02,1,1000.0000000,GBP,1,a@test.com,A,A,900.0000000
+2024/02,2,500.0000000,GBP,1,c@test.com,C,C,500.0000000
+2024/02,3,5100.0000000,GBP,1,b@test.com,B,B,100.0000000
+`
+	output, err := runTest(t, transactions, Config{ReportType: TopGrowth})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_lineEndings(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name:        "LF by default",
+			cfg:         Config{},
+			expectedCSV: "date,rank,amount,currency,transactions,email,firstName,lastName\n2024/01,1,100.0000000,GBP,1,a@test.com,A,A\n",
+		},
+		{
+			name:        "CRLF",
+			cfg:         Config{CRLF: true},
+			expectedCSV: "date,rank,amount,currency,transactions,email,firstName,lastName\r\n2024/01,1,100.0000000,GBP,1,a@test.com,A,A\r\n",
+		},
+		{
+			name:        "CRLF month summaries",
+			cfg:         Config{CRLF: true, OutputFormat: OutputFormatMonthSummaryJSONL},
+			expectedCSV: `{"month":"2024/01","topSpenderEmail":"a@test.com","topAmount":100,"totalSpenders":1,"monthTotal":100}` + "\r\n",
+		},
+		{
+			name:        "CRLF json",
+			cfg:         Config{CRLF: true, OutputFormat: OutputFormatJSON},
+			expectedCSV: `[{"date":"2024/01","rank":1,"amount":100.0000000,"currency":"GBP","transactions":1,"email":"a@test.com","firstName":"A","lastName":"A"}]` + "\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%q\nExpected:\n%q", output, tc.expectedCSV)
+			}
+		})
+	}
+
+	t.Run("CRLF skipped rows", func(t *testing.T) {
+		csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,10/01/2024 12:00
+`
+		errorBuffer := &bytes.Buffer{}
+		if err := TopSpenders(bytes.NewBufferString(csvInput), io.Discard, Config{CRLF: true, ErrorWriter: errorBuffer}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output := errorBuffer.String(); !strings.HasSuffix(output, "}\r\n") || strings.Count(output, "\n") != 1 {
+			t.Errorf("expected a single CRLF terminated line, got %q", output)
+		}
+	})
+}
+
+func TestTopSpenders_nameContains(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "Alice", LastName: "Smith", Email: "alice@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "Bob", LastName: "Jones", Email: "bob@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "Carol", LastName: "Smithson", Email: "carol@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "Alice", LastName: "Smith", Email: "alice@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 13, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,alice@test.com,Alice,Smith
+2024/02,1,300.0000000,GBP,1,carol@test.com,Carol,Smithson
+2024/02,2,50.0000000,GBP,1,alice@test.com,Alice,Smith
+`
+	output, err := runTest(t, transactions, Config{NameContains: "SMITH"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_goldToNonBaseCurrency(t *testing.T) {
+	t.Parallel()
+	// Rates are gold gram prices in GBP, so a GGM->USD row can't be
+	// converted and is rejected with an explicit error.
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,2,GGM,USD,60,10/01/2024 12:00
+`
+	err := TopSpenders(bytes.NewBufferString(csvInput), &bytes.Buffer{}, Config{StopOnError: true})
+	if err == nil {
+		t.Fatal("expected an error but got nil")
+	}
+
+	expected := "line 2: cannot convert GGM to USD: gold is only priced in GBP"
+	if err.Error() != expected {
+		t.Errorf("expected error %q, got %q", expected, err.Error())
+	}
+}
+
+func TestTopSpenders_snapshots(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	snapshots := &bytes.Buffer{}
+	output, err := runTest(t, transactions, Config{SnapshotEvery: 2, SnapshotWriter: snapshots})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// A single snapshot is taken after the first two rows.
+	expectedSnapshots := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+`
+	if snapshots.String() != expectedSnapshots {
+		t.Errorf("snapshots do not match expected value.\nGot:\n%s\nExpected:\n%s", snapshots.String(), expectedSnapshots)
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,300.0000000,GBP,1,c@test.com,C,C
+2024/01,2,200.0000000,GBP,1,b@test.com,B,B
+2024/01,3,100.0000000,GBP,1,a@test.com,A,A
+`
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	t.Run("exactly SnapshotEvery rows", func(t *testing.T) {
+		snapshots := &bytes.Buffer{}
+		if _, err := runTest(t, transactions[:2], Config{SnapshotEvery: 2, SnapshotWriter: snapshots}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if snapshots.String() != expectedSnapshots {
+			t.Errorf("snapshots do not match expected value.\nGot:\n%s\nExpected:\n%s", snapshots.String(), expectedSnapshots)
+		}
+	})
+}
+
+func TestTopSpenders_expectOnlySpend(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txBuyGold, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGGM, Rate: 50, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+	}
+
+	if _, err := runTest(t, transactions, Config{StopOnError: true}); err != nil {
+		t.Fatalf("expected no error by default, got %v", err)
+	}
+
+	if _, err := runTest(t, transactions, Config{StopOnError: true, ExpectOnlySpend: true}); err == nil {
+		t.Error("expected an error but got nil")
+	}
+}
+
+func TestTopSpenders_truncatePolicy(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	// E and F are tied at the 5th position.
+	for i, amount := range []float64{600, 500, 400, 300, 200, 200, 100} {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+
+	testCases := []struct {
+		name       string
+		policy     TruncatePolicy
+		wantEmails []string
+	}{
+		{
+			name:       "hard cut",
+			policy:     HardCut,
+			wantEmails: []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:       "include tied group",
+			policy:     IncludeTiedGroup,
+			wantEmails: []string{"a", "b", "c", "d", "e", "f"},
+		},
+		{
+			name:       "exclude tied group",
+			policy:     ExcludeTiedGroup,
+			wantEmails: []string{"a", "b", "c", "d"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, Config{TruncatePolicy: tc.policy})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			records, err := csv.NewReader(bytes.NewBufferString(output)).ReadAll()
+			if err != nil {
+				t.Fatalf("failed to read output csv: %v", err)
+			}
+			rows := records[1:]
+			if len(rows) != len(tc.wantEmails) {
+				t.Fatalf("expected %d rows, got %d:\n%s", len(tc.wantEmails), len(rows), output)
+			}
+			for i, want := range tc.wantEmails {
+				if rows[i][6] != want {
+					t.Errorf("row %d: expected user %s, got %s", i, want, rows[i][6])
+				}
+			}
+		})
+	}
+}
+
+func TestTopSpenders_ties(t *testing.T) {
+	t.Parallel()
+	// B, C and D are tied, D over more transactions. C is read before B.
+	transactions := []*Transaction{
+		{FirstName: "D", LastName: "D", Email: "d@test.com", TransactionType: txCardSpend, Amount: 150, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 9, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "D", LastName: "D", Email: "d@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 9, 13, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		topN        int
+		expectedCSV string
+	}{
+		{
+			name: "all ranked",
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,2,d@test.com,D,D
+2024/01,2,200.0000000,GBP,1,b@test.com,B,B
+2024/01,3,200.0000000,GBP,1,c@test.com,C,C
+2024/01,4,100.0000000,GBP,1,a@test.com,A,A
+`,
+		},
+		{
+			name: "cut within the tie",
+			topN: 2,
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,2,d@test.com,D,D
+2024/01,2,200.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Repeated, as the order of the aggregates varies between runs.
+			for range 10 {
+				output, err := runTest(t, transactions, Config{TopN: tc.topN})
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+
+				if output != tc.expectedCSV {
+					t.Fatalf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+				}
+			}
+		})
+	}
+}
+
+func TestTopSpenders_countedTypes(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txBuyGold, Amount: 250, FromCurrency: currencyGBP, ToCurrency: currencyGGM, Rate: 50, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txSellGold, Amount: 10, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+	}
+
+	t.Run("several types", func(t *testing.T) {
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,350.0000000,GBP,2,a@test.com,A,A
+2024/01,2,200.0000000,GBP,1,b@test.com,B,B
+`
+		output, err := runTest(t, transactions, Config{CountedTypes: []string{txCardSpend, txBuyGold}})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		_, err := runTest(t, transactions, Config{CountedTypes: []string{"CARD SPENDING"}})
+		if err == nil || err.Error() != "unknown counted transaction type: CARD SPENDING" {
+			t.Fatalf("expected an unknown type error, got %v", err)
+		}
+	})
+}
+
+func TestTopSpenders_orderAsc(t *testing.T) {
+	t.Parallel()
+	// B and C are tied, C is read first.
+	transactions := []*Transaction{
+		{FirstName: "D", LastName: "D", Email: "d@test.com", TransactionType: txCardSpend, Amount: 400, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 9, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+2024/01,2,200.0000000,GBP,1,b@test.com,B,B
+2024/01,3,200.0000000,GBP,1,c@test.com,C,C
+`
+	output, err := runTest(t, transactions, Config{Order: OrderAsc, TopN: 3})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	if _, err := runTest(t, transactions, Config{Order: "random"}); err == nil || err.Error() != "unknown order: random" {
+		t.Errorf("expected an unknown order error, got %v", err)
+	}
+}
+
+func TestTopSpenders_includeOthersRow(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i, amount := range []float64{700, 600, 500, 400, 300, 200, 100} {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	// A second transaction for F, and a small month without an others row.
+	transactions = append(transactions,
+		&Transaction{FirstName: "f", LastName: "f", Email: "f@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		&Transaction{FirstName: "a", LastName: "a", Email: "a@test.com", TransactionType: txCardSpend, Amount: 10, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)},
+	)
+
+	// The others row sums F (250 over 2 transactions) and G (100).
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,700.0000000,GBP,1,a@test.com,a,a
+2024/01,2,600.0000000,GBP,1,b@test.com,b,b
+2024/01,3,500.0000000,GBP,1,c@test.com,c,c
+2024/01,4,400.0000000,GBP,1,d@test.com,d,d
+2024/01,5,300.0000000,GBP,1,e@test.com,e,e
+2024/01,(others),350.0000000,GBP,3,(others),,
+2024/02,1,10.0000000,GBP,1,a@test.com,a,a
+`
+	output, err := runTest(t, transactions, Config{IncludeOthersRow: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_includeMonthlyTotals(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i, amount := range []float64{700, 600, 500, 400, 300, 200, 100} {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	transactions = append(transactions,
+		&Transaction{FirstName: "g", LastName: "g", Email: "g@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		&Transaction{FirstName: "h", LastName: "h", Email: "h@test.com", TransactionType: txSellGold, Amount: 1000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		&Transaction{FirstName: "a", LastName: "a", Email: "a@test.com", TransactionType: txCardSpend, Amount: 10, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)},
+	)
+
+	// The total covers F and G, who aren't ranked, but not the gold sale.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,700.0000000,GBP,1,a@test.com,a,a
+2024/01,2,600.0000000,GBP,1,b@test.com,b,b
+2024/01,3,500.0000000,GBP,1,c@test.com,c,c
+2024/01,4,400.0000000,GBP,1,d@test.com,d,d
+2024/01,5,300.0000000,GBP,1,e@test.com,e,e
+2024/01,TOTAL,2850.0000000,GBP,8,TOTAL,,
+2024/02,1,10.0000000,GBP,1,a@test.com,a,a
+2024/02,TOTAL,10.0000000,GBP,1,TOTAL,,
+`
+	output, err := runTest(t, transactions, Config{IncludeMonthlyTotals: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_includeMonthTotal(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i, amount := range []float64{700, 600, 500, 400, 300, 200} {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	transactions = append(transactions,
+		&Transaction{FirstName: "a", LastName: "a", Email: "a@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+	)
+
+	output, err := runTest(t, transactions, Config{IncludeMonthTotal: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// F isn't ranked, so isn't part of the total.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,750.0000000,GBP,2,a@test.com,a,a
+2024/01,2,600.0000000,GBP,1,b@test.com,b,b
+2024/01,3,500.0000000,GBP,1,c@test.com,c,c
+2024/01,4,400.0000000,GBP,1,d@test.com,d,d
+2024/01,5,300.0000000,GBP,1,e@test.com,e,e
+2024/01,ranked total,2550.0000000,GBP,6,ranked total,,
+`
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	t.Run("month without ranked users", func(t *testing.T) {
+		// Nobody spent on three days, so nobody is ranked.
+		_, err := runTest(t, transactions, Config{IncludeMonthTotal: true, MinActiveDays: 3, EmptyResultBehavior: ErrorOnEmpty})
+		if !errors.Is(err, ErrEmptyResult) {
+			t.Errorf("expected ErrEmptyResult, got %v", err)
+		}
+	})
+
+	// The total matches the rows listed.
+	records, err := csv.NewReader(strings.NewReader(output)).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read output csv: %v", err)
+	}
+	var sum float64
+	var count int
+	for _, record := range records[1 : len(records)-1] {
+		amount, _ := strconv.ParseFloat(record[2], 64)
+		transactions, _ := strconv.Atoi(record[4])
+		sum += amount
+		count += transactions
+	}
+	total := records[len(records)-1]
+	if got := strconv.FormatFloat(sum, 'f', 7, 64); got != total[2] || strconv.Itoa(count) != total[4] {
+		t.Errorf("expected a total of %s over %d transactions, got %s over %s", got, count, total[2], total[4])
+	}
+}
+
+func TestTopSpenders_rateVarianceThreshold(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 1, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txSellGold, Amount: 1, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 80, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 1, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 1, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 52, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)},
+	}
+
+	logs := &bytes.Buffer{}
+	cfg := Config{
+		RateVarianceThreshold: 1.1,
+		Logger:                slog.New(slog.NewTextHandler(logs, nil)),
+	}
+	if _, err := runTest(t, transactions, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Only January's rates differ by more than 10%.
+	if !strings.Contains(logs.String(), `msg="inconsistent rates" month=2024/01 pair=GGM:GBP min=50 max=80`) {
+		t.Errorf("expected a warning for January, got logs:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "month=2024/02") {
+		t.Errorf("expected no warning for February, got logs:\n%s", logs.String())
+	}
+}
+
+func TestTopSpenders_includeDistinctMerchants(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i, merchant := range []string{"M1", "M2", "M1", "M3"} {
+		transactions = append(transactions, &Transaction{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 10, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, MerchantCode: merchant, Date: time.Date(2024, 1, 10+i, 12, 0, 0, 0, time.UTC)})
+	}
+	transactions = append(transactions, &Transaction{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 20, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, MerchantCode: "M1", Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName,distinctMerchants
+2024/01,1,40.0000000,GBP,4,a@test.com,A,A,3
+2024/01,2,20.0000000,GBP,1,b@test.com,B,B,1
+`
+	output, err := runTest(t, transactions, Config{IncludeDistinctMerchants: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_integerAmountsOnly(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,100.50,GBP,GBP,1,11/01/2024 12:00
+C,C,c@test.com,CARD SPEND,5013,200,GBP,GBP,1.0,12/01/2024 12:00
+D,D,d@test.com,CARD SPEND,5013,1e2,GBP,GBP,1,13/01/2024 12:00
+E,E,e@test.com,CARD SPEND,5013,1e-2,GBP,GBP,1,14/01/2024 12:00
+F,F,f@test.com,CARD SPEND,5013,300,GBP,GBP,1e0,15/01/2024 12:00
+`
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`
+	outBuffer := &bytes.Buffer{}
+	if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, Config{IntegerAmountsOnly: true}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output := outBuffer.String(); output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	err := TopSpenders(bytes.NewBufferString(csvInput), io.Discard, Config{IntegerAmountsOnly: true, StopOnError: true})
+	if err == nil || !strings.Contains(err.Error(), "non-integer amount: 100.50") {
+		t.Errorf("expected a non-integer amount error, got %v", err)
+	}
+}
+
+func TestTopSpenders_defaultCurrency(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,,,,10/01/2024 12:00
+A,A,a@test.com,CARD SPEND,5013,50,GBP,,1,11/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,2,GGM,,50,12/01/2024 12:00
+`
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,150.0000000,GBP,2,a@test.com,A,A
+2024/01,2,100.0000000,GBP,1,b@test.com,B,B
+`
+	outBuffer := &bytes.Buffer{}
+	cfg := Config{DefaultCurrency: currencyGBP, StopOnError: true}
+	if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output := outBuffer.String(); output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	if err := TopSpenders(bytes.NewBufferString(csvInput), io.Discard, Config{StopOnError: true}); err == nil {
+		t.Error("expected rows without a currency to be rejected by default")
+	}
+}
+
+func TestTopSpenders_separateDateTime(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Time,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,23:30,31/01/2024
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,00:15,01/02/2024
+`
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+2024/02,1,200.0000000,GBP,1,b@test.com,B,B
+`
+	outBuffer := &bytes.Buffer{}
+	cfg := Config{SeparateDateTime: true, DateColumn: 10, TimeColumn: 9, StopOnError: true}
+	if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output := outBuffer.String(); output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	tx, err := decodeRecord([]string{"A", "A", "a@test.com", "CARD SPEND", "5013", "100", "GBP", "GBP", "1", "31/01/2024", "23:30"}, &Config{SeparateDateTime: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if expected := time.Date(2024, 1, 31, 23, 30, 0, 0, time.UTC); !tx.Date.Equal(expected) {
+		t.Errorf("expected date %v, got %v", expected, tx.Date)
+	}
+}
+
+func TestTopSpenders_headerSource(t *testing.T) {
+	t.Parallel()
+	header := "First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date\n"
+	data := `A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00
+`
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+`
+	outBuffer := &bytes.Buffer{}
+	cfg := Config{HeaderSource: strings.NewReader(header), StopOnError: true}
+	if err := TopSpenders(bytes.NewBufferString(data), outBuffer, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output := outBuffer.String(); output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_dailyRates(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 10, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 400, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 5, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+	}
+	dailyRates := map[string]map[string]float64{
+		"2024-01-10": {currencyGGM: 30},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "daily rate overrides the row rate",
+			cfg:  Config{DailyRates: dailyRates},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,400.0000000,GBP,1,b@test.com,B,B
+2024/01,2,300.0000000,GBP,1,a@test.com,A,A
+2024/01,3,250.0000000,GBP,1,c@test.com,C,C
+`,
+		},
+		{
+			name: "rows without a daily rate are rejected",
+			cfg:  Config{DailyRates: dailyRates, RequireDailyRate: true},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,400.0000000,GBP,1,b@test.com,B,B
+2024/01,2,300.0000000,GBP,1,a@test.com,A,A
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+
+	t.Run("rows with an empty rate take the daily rate", func(t *testing.T) {
+		csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,10,GGM,GBP,,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,400,GBP,GBP,1,11/01/2024 12:00
+`
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,400.0000000,GBP,1,b@test.com,B,B
+2024/01,2,300.0000000,GBP,1,a@test.com,A,A
+`
+		outBuffer := &bytes.Buffer{}
+		if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, Config{DailyRates: dailyRates, StopOnError: true}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output := outBuffer.String(); output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+}
+
+func TestTopSpenders_recencyWeighting(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 30, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 150, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)},
+	}
+
+	// B spent as much as A, but later in the month. C spent the most, but
+	// two weeks before the end of the month.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,b@test.com,B,B
+2024/01,2,150.0000000,GBP,1,c@test.com,C,C
+2024/01,3,100.0000000,GBP,1,a@test.com,A,A
+`
+	output, err := runTest(t, transactions, Config{RecencyWeighting: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_jsonNested(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	output, err := runTest(t, transactions, Config{OutputFormat: OutputFormatJSONNested})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var months map[string][]Row
+	if err := json.Unmarshal([]byte(output), &months); err != nil {
+		t.Fatalf("expected valid json, got %v:\n%s", err, output)
+	}
+	if len(months) != 2 || len(months["2024/01"]) != 2 || len(months["2024/02"]) != 1 {
+		t.Fatalf("expected 2 rows in 2024/01 and 1 in 2024/02, got %s", output)
+	}
+
+	expected := Row{Date: "2024/02", Rank: 1, Amount: "2500.0000000", Currency: currencyGBP, Transactions: 1, Email: "c@test.com", FirstName: "C", LastName: "C"}
+	if got := months["2024/02"][0]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected row %+v, got %+v", expected, got)
+	}
+	if got := months["2024/01"][0].Email; got != "b@test.com" {
+		t.Errorf("expected b@test.com to rank first in 2024/01, got %s", got)
+	}
+}
+
+func TestTopSpenders_monthSummaryJSONL(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i, amount := range []float64{700, 600, 500, 400, 300, 200} {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	transactions = append(transactions, &Transaction{FirstName: "a", LastName: "a", Email: "a@test.com", TransactionType: txCardSpend, Amount: 10, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)})
+
+	output, err := runTest(t, transactions, Config{OutputFormat: OutputFormatMonthSummaryJSONL})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	expected := []MonthSummary{
+		{Month: "2024/01", TopSpenderEmail: "a@test.com", TopAmount: 700, TotalSpenders: 6, MonthTotal: 2700},
+		{Month: "2024/02", TopSpenderEmail: "a@test.com", TopAmount: 500, TotalSpenders: 1, MonthTotal: 500},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got:\n%s", len(expected), output)
+	}
+	for i, line := range lines {
+		var got MonthSummary
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("expected valid json on line %d, got %v: %s", i+1, err, line)
+		}
+		if got != expected[i] {
+			t.Errorf("expected summary %+v, got %+v", expected[i], got)
+		}
+	}
+}
+
+func TestTopSpenders_winsorizeTxGBP(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 800, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 20, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)}, // 20*50 = 1000 GBP
+	}
+
+	// A's single huge transaction counts for 1000 GBP only.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,1800.0000000,GBP,2,b@test.com,B,B
+2024/01,2,1000.0000000,GBP,1,a@test.com,A,A
+`
+	output, err := runTest(t, transactions, Config{WinsorizeTxGBP: 1000})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_goldToGold(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 3, FromCurrency: currencyGGM, ToCurrency: currencyGGM, Rate: 50, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 2, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+	}
+
+	// The grams spent are valued at the gram price on both rows.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,150.0000000,GBP,1,a@test.com,A,A
+2024/01,2,100.0000000,GBP,1,b@test.com,B,B
+`
+	output, err := runTest(t, transactions, Config{StopOnError: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_outputTargets(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 2000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	bigSpenders, everyone := &bytes.Buffer{}, &bytes.Buffer{}
+	cfg := Config{
+		OutputTargets: []OutputTarget{
+			{
+				Writer: bigSpenders,
+				Filter: func(r Row) bool {
+					amount, _ := r.Amount.Float64()
+					return r.Currency == currencyGBP && amount > 1000
+				},
+			},
+			{
+				Writer: everyone,
+				Format: OutputFormatJSONNested,
+			},
+		},
+	}
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,2000.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+2024/02,1,2500.0000000,GBP,1,c@test.com,C,C
+`
+	output, err := runTest(t, transactions, cfg)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+
+	expectedBigSpenders := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,2000.0000000,GBP,1,b@test.com,B,B
+2024/02,1,2500.0000000,GBP,1,c@test.com,C,C
+`
+	if got := bigSpenders.String(); got != expectedBigSpenders {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", got, expectedBigSpenders)
+	}
+
+	var months map[string][]Row
+	if err := json.Unmarshal(everyone.Bytes(), &months); err != nil {
+		t.Fatalf("expected valid json, got %v:\n%s", err, everyone.String())
+	}
+	if len(months["2024/01"]) != 2 || len(months["2024/02"]) != 1 {
+		t.Errorf("expected every row in the json target, got %s", everyone.String())
+	}
+}
+
+func TestTopSpenders_matrix(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 2, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "empty cells",
+			cfg:  Config{OutputFormat: OutputFormatMatrix},
+			expectedCSV: `email,2024/01,2024/02
+a@test.com,100.0000000,100.0000000
+b@test.com,200.0000000,
+`,
+		},
+		{
+			name: "zero filled cells",
+			cfg:  Config{OutputFormat: OutputFormatMatrix, MatrixZeroFill: true},
+			expectedCSV: `email,2024/01,2024/02
+a@test.com,100.0000000,100.0000000
+b@test.com,200.0000000,0.0000000
+`,
+		},
+		{
+			name: "capped totals",
+			cfg:  Config{OutputFormat: OutputFormatMatrix, CapMonthlySpend: 150},
+			expectedCSV: `email,2024/01,2024/02
+a@test.com,100.0000000,100.0000000
+b@test.com,150.0000000,
+`,
+		},
+		{
+			name: "output currency",
+			cfg:  Config{OutputFormat: OutputFormatMatrix, OutputCurrency: "EUR", GBPToOutputRate: 1.2},
+			expectedCSV: `email,2024/01,2024/02
+a@test.com,120.0000000,120.0000000
+b@test.com,240.0000000,
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+
+	t.Run("rank per currency", func(t *testing.T) {
+		if _, err := runTest(t, transactions, Config{OutputFormat: OutputFormatMatrix, RankPerCurrency: true}); err == nil {
+			t.Error("expected an error but got nil")
+		}
+	})
+}
+
+func TestTopSpenders_capMonthlySpend(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 1000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 5000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 3000, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 1500, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "uncapped",
+			cfg:  Config{ReportType: TopGrowth},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName,growthGBP
+2024/02,1,5000.0000000,GBP,1,a@test.com,A,A,4000.0000000
+2024/02,2,3000.0000000,GBP,1,b@test.com,B,B,3000.0000000
+2024/02,3,1500.0000000,GBP,1,c@test.com,C,C,1500.0000000
+`,
+		},
+		{
+			// A grows from 1000 to the 2000 cap only.
+			name: "capped",
+			cfg:  Config{ReportType: TopGrowth, CapMonthlySpend: 2000},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName,growthGBP
+2024/02,1,2000.0000000,GBP,1,b@test.com,B,B,2000.0000000
+2024/02,2,1500.0000000,GBP,1,c@test.com,C,C,1500.0000000
+2024/02,3,2000.0000000,GBP,1,a@test.com,A,A,1000.0000000
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_refundsReduceSpend(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txRefund, Amount: 2, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)}, // 2*50 = 100 GBP
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 250, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txRefund, Amount: 40, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "refunds ignored",
+			cfg:  Config{},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,300.0000000,GBP,1,a@test.com,A,A
+2024/01,2,250.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+		{
+			name: "refunds reduce spend",
+			cfg:  Config{RefundsReduceSpend: true},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,250.0000000,GBP,1,b@test.com,B,B
+2024/01,2,200.0000000,GBP,2,a@test.com,A,A
+2024/01,3,-40.0000000,GBP,1,c@test.com,C,C
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_onRankChange(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 10, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 20, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 5, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)},
+	}
+
+	var events []string
+	cfg := Config{
+		OnRankChange: func(month int, email string, oldRank, newRank int) {
+			events = append(events, fmt.Sprintf("%d %s %d->%d", month, email, oldRank, newRank))
+		},
+	}
+	if _, err := runTest(t, transactions, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// A's last transaction doesn't catch up with B, so it changes nothing.
+	expected := []string{
+		"202401 a@test.com 0->1",
+		"202401 b@test.com 0->2",
+		"202401 b@test.com 2->1",
+		"202401 a@test.com 1->2",
+		"202401 c@test.com 0->3",
+		"202402 c@test.com 0->1",
+	}
+	if !slices.Equal(events, expected) {
+		t.Errorf("expected events %q, got %q", expected, events)
+	}
+
+	t.Run("unsorted input", func(t *testing.T) {
+		unsorted := []*Transaction{transactions[5], transactions[0]}
+		_, err := runTest(t, unsorted, cfg)
+		if err == nil || err.Error() != "input not sorted by date: 2024/01 after 2024/02" {
+			t.Fatalf("expected an unsorted input error, got %v", err)
+		}
+	})
+}
+
+func TestLiveRanking_add(t *testing.T) {
+	t.Parallel()
+	l := newLiveRanking(202401)
+	for email, amount := range map[string]float64{"a": 40, "b": 30, "c": 20, "d": 10} {
+		l.add(email, amount)
+	}
+
+	// D overtakes everyone, the others move down by one.
+	expected := []rankChange{
+		{email: "d", oldRank: 4, newRank: 1},
+		{email: "a", oldRank: 1, newRank: 2},
+		{email: "b", oldRank: 2, newRank: 3},
+		{email: "c", oldRank: 3, newRank: 4},
+	}
+	if got := l.add("d", 100); !slices.Equal(got, expected) {
+		t.Errorf("expected changes %+v, got %+v", expected, got)
+	}
+
+	// A refund moves D back below B.
+	expected = []rankChange{
+		{email: "d", oldRank: 1, newRank: 3},
+		{email: "a", oldRank: 2, newRank: 1},
+		{email: "b", oldRank: 3, newRank: 2},
+	}
+	if got := l.add("d", -85); !slices.Equal(got, expected) {
+		t.Errorf("expected changes %+v, got %+v", expected, got)
+	}
+}
+
+func TestTopSpenders_histogram(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i, amount := range []float64{10, 240, 250, 260, 499, 1000} {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	transactions = append(transactions, &Transaction{FirstName: "a", LastName: "a", Email: "a@test.com", TransactionType: txCardSpend, Amount: 5, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)})
+
+	expectedCSV := `date,fromGBP,toGBP,count
+2024/01,0.0000000,250.0000000,2
+2024/01,250.0000000,500.0000000,3
+2024/01,1000.0000000,1250.0000000,1
+2024/02,250.0000000,500.0000000,1
+`
+	output, err := runTest(t, transactions, Config{Histogram: true, HistogramBucketGBP: 250})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_includeCountPercentile(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	// A spends the most in one go, E transacts the most. B and C are tied.
+	for i, count := range []int{1, 2, 2, 3, 4} {
+		email := string(rune('a' + i))
+		amount := 100.0
+		if i == 0 {
+			amount = 1000
+		}
+		for day := range count {
+			transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10+day, 12, 0, 0, 0, time.UTC)})
+		}
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName,countPercentile
+2024/01,1,1000.0000000,GBP,1,a@test.com,a,a,20.00
+2024/01,2,400.0000000,GBP,4,e@test.com,e,e,100.00
+2024/01,3,300.0000000,GBP,3,d@test.com,d,d,80.00
+`
+	output, err := runTest(t, transactions, Config{IncludeCountPercentile: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if !strings.HasPrefix(output, expectedCSV) {
+		t.Fatalf("output csv does not match expected value.\nGot:\n%s\nExpected prefix:\n%s", output, expectedCSV)
+	}
+	// B and C share the same percentile.
+	for _, email := range []string{"b@test.com", "c@test.com"} {
+		if !strings.Contains(output, "200.0000000,GBP,2,"+email+",") || !strings.Contains(output, email+","+email[:1]+","+email[:1]+",60.00\n") {
+			t.Errorf("expected %s at the 60th count percentile, got:\n%s", email, output)
+		}
+	}
+}
+
+func TestTopSpenders_padToTopN(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+2024/01,3,0.0000000,GBP,0,,,
+2024/01,4,0.0000000,GBP,0,,,
+2024/01,5,0.0000000,GBP,0,,,
+`
+	output, err := runTest(t, transactions, Config{PadToTopN: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_includePercentiles(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i, amount := range []float64{700, 100, 300, 200, 600, 400} {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+
+	// The median is between 300 and 400, over all six users.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,700.0000000,GBP,1,a@test.com,a,a
+2024/01,2,600.0000000,GBP,1,e@test.com,e,e
+2024/01,3,400.0000000,GBP,1,f@test.com,f,f
+2024/01,4,300.0000000,GBP,1,c@test.com,c,c
+2024/01,5,200.0000000,GBP,1,d@test.com,d,d
+2024/01,p50,350.0000000,GBP,0,,,
+2024/01,p90,650.0000000,GBP,0,,,
+`
+	output, err := runTest(t, transactions, Config{IncludePercentiles: []float64{0.5, 0.9}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_stableDisplayNames(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "Robert", LastName: "Smith", Email: "b@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "Bob", LastName: "Smith", Email: "b@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "Rob", LastName: "Smith", Email: "b@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,300.0000000,GBP,3,b@test.com,Bob,Smith
+`
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 0, 2}} {
+		ordered := make([]*Transaction, len(order))
+		for i, j := range order {
+			ordered[i] = transactions[j]
+		}
+		output, err := runTest(t, ordered, Config{})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value for order %v.\nGot:\n%s\nExpected:\n%s", order, output, expectedCSV)
+		}
+	}
+}
+
+func TestTopSpenders_logLevel(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
+`
+	logs := &bytes.Buffer{}
+	cfg := Config{
+		// Every run is slow enough to warn about.
+		SlowThreshold: time.Nanosecond,
+		LogLevel:      slog.LevelError,
+		Logger:        slog.New(slog.NewTextHandler(logs, nil)),
+	}
+	if err := TopSpenders(strings.NewReader(csvInput), io.Discard, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if strings.Contains(logs.String(), "slow processing") {
+		t.Errorf("expected warnings to be suppressed, got logs:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "input error") {
+		t.Errorf("expected errors to be logged, got logs:\n%s", logs.String())
+	}
+}
+
+func TestTopSpenders_topPercentile(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i := 1; i <= 100; i++ {
+		email := fmt.Sprintf("user%03d@test.com", i)
+		transactions = append(transactions, &Transaction{FirstName: "U", LastName: "U", Email: email, TransactionType: txCardSpend, Amount: float64(i), FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+
+	// 5% of 100 users.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,user100@test.com,U,U
+2024/01,2,99.0000000,GBP,1,user099@test.com,U,U
+2024/01,3,98.0000000,GBP,1,user098@test.com,U,U
+2024/01,4,97.0000000,GBP,1,user097@test.com,U,U
+2024/01,5,96.0000000,GBP,1,user096@test.com,U,U
+`
+	output, err := runTest(t, transactions, Config{TopPercentile: 0.05})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_onMonthComplete(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	var months []string
+	cfg := Config{
+		OnMonthComplete: func(month int, ranked []*UserMonthlySpending) {
+			summary := strconv.Itoa(month)
+			for _, us := range ranked {
+				summary += fmt.Sprintf(" %s:%v", us.Email, us.TotalGBP)
+			}
+			months = append(months, summary)
+		},
+	}
+	if _, err := runTest(t, transactions, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := []string{
+		"202401 b@test.com:200.0000000 a@test.com:100.0000000",
+		"202402 a@test.com:300.0000000",
+	}
+	if !slices.Equal(months, expected) {
+		t.Errorf("expected months %q, got %q", expected, months)
+	}
+}
+
+func TestTopSpenders_quoteAllFields(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: `A "Junior"`, Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `"date","rank","amount","currency","transactions","email","firstName","lastName"
+"2024/01","1","100.0000000","GBP","1","a@test.com","A","A ""Junior"""
+`
+	output, err := runTest(t, transactions, Config{QuoteAllFields: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_rankPerCurrency(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 3, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "D", LastName: "D", Email: "d@test.com", TransactionType: txCardSpend, Amount: 5, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 2, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 60, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 40, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)},
+	}
+
+	// GGM spenders are ranked and reported by the grams spent.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+2024/01,1,5.0000000,GGM,1,d@test.com,D,D
+2024/01,2,3.0000000,GGM,1,c@test.com,C,C
+2024/02,1,40.0000000,GBP,1,c@test.com,C,C
+2024/02,1,2.0000000,GGM,1,a@test.com,A,A
+`
+	output, err := runTest(t, transactions, Config{RankPerCurrency: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_dedupeByID(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date,Transaction id
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00,tx-1
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00,tx-2
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00,tx-1
+A,A,a@test.com,CARD SPEND,5013,50,GBP,GBP,1,12/01/2024 12:00,tx-3
+`
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+2024/01,2,150.0000000,GBP,2,a@test.com,A,A
+`
+	testCases := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "by column", cfg: Config{DedupeByID: true, IDColumn: 10}},
+		{name: "by header", cfg: Config{DedupeByID: true, IDHeader: "Transaction id"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outBuffer := &bytes.Buffer{}
+			if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, tc.cfg); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output := outBuffer.String(); output != expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+			}
+		})
+	}
+
+	errorCases := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "no column", cfg: Config{DedupeByID: true}},
+		{name: "negative column", cfg: Config{DedupeByID: true, IDColumn: -1}},
+		{name: "header not found", cfg: Config{DedupeByID: true, IDHeader: "Reference"}},
+	}
+
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outBuffer := &bytes.Buffer{}
+			if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, tc.cfg); err == nil {
+				t.Fatal("expected an error but got nil")
+			}
+		})
+	}
+}
+
+func TestTopSpenders_monthOrderDesc(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/02,1,300.0000000,GBP,1,a@test.com,A,A
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+`
+	output, err := runTest(t, transactions, Config{MonthOrder: MonthOrderDesc})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_verifyHeader(t *testing.T) {
+	t.Parallel()
+	data := `A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+`
+	testCases := []struct {
+		name    string
+		header  string
+		wantErr string
+	}{
+		{
+			name:   "expected header",
+			header: "First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date\n",
+		},
+		{
+			name:    "missing column",
+			header:  "First name,Last name,Email,Description,Amount,From Currency,To Currency,Rate,Date\n",
+			wantErr: "unexpected header: 9 < 10 columns",
+		},
+		{
+			name:    "renamed column",
+			header:  "First name,Last name,Email,Type,Merchant code,Amount,From Currency,To Currency,Rate,Date\n",
+			wantErr: `unexpected header: column 4 is "Type", expected "Description"`,
+		},
+		{
+			name:    "no known column names",
+			header:  "a,b,c,d,e,f,g,h,i,j\n",
+			wantErr: `unexpected header: column 1 is "a", expected "First name"`,
+		},
+		{
+			name:    "data row",
+			header:  "B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00\n",
+			wantErr: `unexpected header: column 1 is "B", expected "First name"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outBuffer := &bytes.Buffer{}
+			err := TopSpenders(bytes.NewBufferString(tc.header+data), outBuffer, Config{VerifyHeader: true})
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+			if outBuffer.Len() > 0 {
+				t.Errorf("expected no output, got:\n%s", outBuffer.String())
+			}
+		})
+	}
+}
+
+func TestTopSpenders_outputTemplate(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+	}
+	tmpl := template.Must(template.New("report").Parse(`{{.Month}}
+{{range .Rows}}rank {{.Rank}}: {{.Email}} ({{printf "%.2f" .Amount.Float64}})
+{{end}}`))
+
+	expected := `2024/01
+rank 1: b@test.com (200.00)
+rank 2: a@test.com (100.00)
+2024/02
+rank 1: a@test.com (300.00)
+`
+	output, err := runTest(t, transactions, Config{OutputTemplate: tmpl})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expected {
+		t.Errorf("output does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expected)
+	}
+}
+
+func TestTopSpenders_emailAliases(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a.work@test.com", TransactionType: txCardSpend, Amount: 150, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	// The canonical email is reported even though the aliases sort before it.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,250.0000000,GBP,2,z@test.com,A,A
+2024/01,2,200.0000000,GBP,1,b@test.com,B,B
+`
+	cfg := Config{EmailAliases: map[string]string{
+		"a@test.com":      "z@test.com",
+		"a.work@test.com": "z@test.com",
+	}}
+	output, err := runTest(t, transactions, cfg)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_minActiveDays(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 500, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 10, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 500, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 18, 0, 0, 0, time.UTC)},
+	}
+
+	// B spent the most, all on a single day.
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,150.0000000,GBP,2,a@test.com,A,A
+`
+	output, err := runTest(t, transactions, Config{MinActiveDays: 2})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_includeCountRank(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	// A spends the most in one go, D and E transact as often.
+	for i, spend := range []struct {
+		count  int
+		amount float64
+	}{{1, 1000}, {4, 100}, {3, 100}, {2, 75}, {2, 60}} {
+		email := string(rune('a' + i))
+		for day := range spend.count {
+			transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: spend.amount, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10+day, 12, 0, 0, 0, time.UTC)})
+		}
+	}
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName,countRank
+2024/01,1,1000.0000000,GBP,1,a@test.com,a,a,5
+2024/01,2,400.0000000,GBP,4,b@test.com,b,b,1
+2024/01,3,300.0000000,GBP,3,c@test.com,c,c,2
+2024/01,4,150.0000000,GBP,2,d@test.com,d,d,3
+2024/01,5,120.0000000,GBP,2,e@test.com,e,e,3
+`
+	output, err := runTest(t, transactions, Config{IncludeCountRank: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+}
+
+func TestTopSpenders_gzipOutput(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+`
+
+	t.Run("compressed report", func(t *testing.T) {
+		outBuffer := &bytes.Buffer{}
+		if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, Config{GzipOutput: true}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		gz, err := gzip.NewReader(outBuffer)
+		if err != nil {
+			t.Fatalf("expected gzip output, got %v", err)
+		}
+		output, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+`
+		if string(output) != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+
+	t.Run("close error", func(t *testing.T) {
+		// The gzip header is written with the report, the compressed report
+		// only when closing.
+		w := &failingWriter{okWrites: 1}
+		err := TopSpenders(bytes.NewBufferString(csvInput), w, Config{GzipOutput: true})
+		if err == nil || !strings.Contains(err.Error(), "closing gzip output") {
+			t.Errorf("expected a gzip close error, got %v", err)
+		}
+	})
+
+	t.Run("no output", func(t *testing.T) {
+		outBuffer := &bytes.Buffer{}
+		if err := TopSpenders(bytes.NewBufferString(csvInput), outBuffer, Config{GzipOutput: true, EmptyResultBehavior: NoOutput, NameContains: "nobody"}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if outBuffer.Len() > 0 {
+			t.Errorf("expected no output, got %d bytes", outBuffer.Len())
+		}
+	})
+}
+
+// failingWriter fails every write after the first okWrites.
+type failingWriter struct {
+	okWrites int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.okWrites == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.okWrites--
+	return len(p), nil
+}
+
+func TestTopSpenders_topN(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i := range 7 {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: float64(100 * (i + 1)), FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)})
+	}
+	// February has fewer spenders than ranked.
+	transactions = append(transactions,
+		&Transaction{FirstName: "a", LastName: "a", Email: "a@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)},
+		&Transaction{FirstName: "b", LastName: "b", Email: "b@test.com", TransactionType: txCardSpend, Amount: 60, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)},
+	)
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "default",
+			cfg:  Config{},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,700.0000000,GBP,1,g@test.com,g,g
+2024/01,2,600.0000000,GBP,1,f@test.com,f,f
+2024/01,3,500.0000000,GBP,1,e@test.com,e,e
+2024/01,4,400.0000000,GBP,1,d@test.com,d,d
+2024/01,5,300.0000000,GBP,1,c@test.com,c,c
+2024/02,1,60.0000000,GBP,1,b@test.com,b,b
+2024/02,2,50.0000000,GBP,1,a@test.com,a,a
+`,
+		},
+		{
+			name: "top 3",
+			cfg:  Config{TopN: 3},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,700.0000000,GBP,1,g@test.com,g,g
+2024/01,2,600.0000000,GBP,1,f@test.com,f,f
+2024/01,3,500.0000000,GBP,1,e@test.com,e,e
+2024/02,1,60.0000000,GBP,1,b@test.com,b,b
+2024/02,2,50.0000000,GBP,1,a@test.com,a,a
+`,
+		},
+		{
+			name: "every spender",
+			cfg:  Config{TopN: -1},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,700.0000000,GBP,1,g@test.com,g,g
+2024/01,2,600.0000000,GBP,1,f@test.com,f,f
+2024/01,3,500.0000000,GBP,1,e@test.com,e,e
+2024/01,4,400.0000000,GBP,1,d@test.com,d,d
+2024/01,5,300.0000000,GBP,1,c@test.com,c,c
+2024/01,6,200.0000000,GBP,1,b@test.com,b,b
+2024/01,7,100.0000000,GBP,1,a@test.com,a,a
+2024/02,1,60.0000000,GBP,1,b@test.com,b,b
+2024/02,2,50.0000000,GBP,1,a@test.com,a,a
+`,
+		},
+		{
+			name: "padded to top 3",
+			cfg:  Config{TopN: 3, PadToTopN: true},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,700.0000000,GBP,1,g@test.com,g,g
+2024/01,2,600.0000000,GBP,1,f@test.com,f,f
+2024/01,3,500.0000000,GBP,1,e@test.com,e,e
+2024/02,1,60.0000000,GBP,1,b@test.com,b,b
+2024/02,2,50.0000000,GBP,1,a@test.com,a,a
+2024/02,3,0.0000000,GBP,0,,,
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_json(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200.5, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC)},
+	}
+
+	expected := `[{"date":"2024/01","rank":1,"amount":200.5000000,"currency":"GBP","transactions":1,"email":"b@test.com","firstName":"B","lastName":"B"},` +
+		`{"date":"2024/01","rank":2,"amount":100.0000000,"currency":"GBP","transactions":1,"email":"a@test.com","firstName":"A","lastName":"A"},` +
+		`{"date":"2024/02","rank":1,"amount":2500.0000000,"currency":"GBP","transactions":1,"email":"c@test.com","firstName":"C","lastName":"C"}]` + "\n"
+	output, err := runTest(t, transactions, Config{OutputFormat: OutputFormatJSON})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output != expected {
+		t.Errorf("output json does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expected)
+	}
+
+	t.Run("optional columns and synthetic rows", func(t *testing.T) {
+		expected := `[{"date":"2024/01","rank":1,"amount":200.5000000,"currency":"GBP","transactions":1,"email":"b@test.com","firstName":"B","lastName":"B","segment":"top"},` +
+			`{"date":"2024/01","rank":2,"amount":100.0000000,"currency":"GBP","transactions":1,"email":"a@test.com","firstName":"A","lastName":"A","segment":"bottom"},` +
+			`{"date":"2024/01","label":"ranked total","amount":300.5000000,"currency":"GBP","transactions":2,"email":"ranked total","firstName":"","lastName":"","segment":"top"},` +
+			`{"date":"2024/02","rank":1,"amount":2500.0000000,"currency":"GBP","transactions":1,"email":"c@test.com","firstName":"C","lastName":"C","segment":"top"},` +
+			`{"date":"2024/02","label":"ranked total","amount":2500.0000000,"currency":"GBP","transactions":1,"email":"ranked total","firstName":"","lastName":"","segment":"top"}]` + "\n"
+		output, err := runTest(t, transactions, Config{OutputFormat: OutputFormatJSON, TopN: 1, IncludeBottomN: 1, IncludeMonthTotal: true})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expected {
+			t.Errorf("output json does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expected)
+		}
+	})
+}
+
+func TestTopSpenders_jsonMatchesCSV(t *testing.T) {
+	t.Parallel()
+	var transactions []*Transaction
+	for i := range 12 {
+		email := string(rune('a' + i))
+		transactions = append(transactions, &Transaction{FirstName: email, LastName: email, Email: email + "@test.com", TransactionType: txCardSpend, Amount: float64(10 + (i*7)%12), FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, time.Month(1+i%3), 10, 12, 0, 0, 0, time.UTC)})
+	}
+
+	for _, cfg := range []Config{{}, {TopN: 2}, {MonthOrder: MonthOrderDesc}} {
+		csvOutput, err := runTest(t, transactions, cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		records, err := csv.NewReader(strings.NewReader(csvOutput)).ReadAll()
+		if err != nil {
+			t.Fatalf("expected valid csv, got %v", err)
+		}
+
+		cfg.OutputFormat = OutputFormatJSON
+		jsonOutput, err := runTest(t, transactions, cfg)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		var rows []map[string]any
+		if err := json.Unmarshal([]byte(jsonOutput), &rows); err != nil {
+			t.Fatalf("expected valid json, got %v:\n%s", err, jsonOutput)
+		}
+
+		if len(rows) != len(records)-1 {
+			t.Fatalf("expected %d json rows, got %d", len(records)-1, len(rows))
+		}
+		for i, row := range rows {
+			record := records[i+1]
+			got := fmt.Sprintf("%v,%v,%v", row["date"], row["rank"], row["email"])
+			want := record[0] + "," + record[1] + "," + record[5]
+			if got != want {
+				t.Errorf("row %d: expected %s as in the csv, got %s", i, want, got)
+			}
+		}
+	}
+}
+
+func TestComputeTopSpenders(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+C,C,c@test.com,CARD SPEND,5013,5,GGM,GBP,50,12/02/2024 12:00
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00
+A,A,a@test.com,CARD SPEND,5013,50,GBP,GBP,1,13/01/2024 12:00
+`
+	rankings, err := ComputeTopSpenders(bytes.NewBufferString(csvInput), Config{IncludeOthersRow: true, TopN: 1})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// The others row of January is left out.
+	expected := []MonthlyRanking{
+		{Month: 202401, Spenders: []*UserMonthlySpending{{FirstName: "B", LastName: "B", Email: "b@test.com", TotalGBP: DecimalFromFloat(200), TransactionCount: 1}}},
+		{Month: 202402, Spenders: []*UserMonthlySpending{{FirstName: "C", LastName: "C", Email: "c@test.com", TotalGBP: DecimalFromFloat(250), TransactionCount: 1}}},
+	}
+	if !reflect.DeepEqual(rankings, expected) {
+		t.Errorf("expected rankings %s, got %s", formatRankings(expected), formatRankings(rankings))
+	}
+}
+
+func formatRankings(rankings []MonthlyRanking) string {
+	var b strings.Builder
+	for _, ranking := range rankings {
+		fmt.Fprintf(&b, "%d:", ranking.Month)
+		for _, us := range ranking.Spenders {
+			fmt.Fprintf(&b, " %+v", *us)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func TestUserMonthlySpending_update(t *testing.T) {
+	t.Parallel()
+	// Summed as float64, these drift to 10000.0000002.
+	tx := &Transaction{Email: "a@test.com", TransactionType: txCardSpend, Amount: 0.1, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 0.1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)}
+	us := &UserMonthlySpending{}
+	for range 1_000_000 {
+		us.update(tx, &Config{})
+	}
+
+	if got := us.TotalGBP.String(); got != "10000.0000000" {
+		t.Errorf("expected a total of 10000.0000000, got %s", got)
+	}
+}
+
+func TestTopSpenders_outputCurrency(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 4, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+	}
 
-		// Processing should stop on the first error, the output-writing function should never be called.
-		if outBuffer.Len() > 0 {
-			t.Errorf("expected empty output, but got: %s", outBuffer.String())
+	t.Run("converted amounts", func(t *testing.T) {
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,230.0000000,EUR,1,b@test.com,B,B
+2024/01,2,115.0000000,EUR,1,a@test.com,A,A
+`
+		output, err := runTest(t, transactions, Config{OutputCurrency: "EUR", GBPToOutputRate: 1.15})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
 		}
 	})
 
-	t.Run("continues on error when flag is not set", func(t *testing.T) {
-		t.Parallel()
-		// Use the same malformed input as the previous test.
-		csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+	t.Run("missing rate", func(t *testing.T) {
+		_, err := runTest(t, transactions, Config{OutputCurrency: "EUR"})
+		if err == nil || err.Error() != "invalid rate for output currency EUR: 0" {
+			t.Errorf("expected an invalid rate error, got %v", err)
+		}
+	})
+}
+
+func TestTopSpenders_dateRange(t *testing.T) {
+	t.Parallel()
+	from := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: from.Add(-time.Minute)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: from},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 300, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: to},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 400, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: to.Add(time.Minute)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "bounds are included",
+			cfg:  Config{From: from, To: to},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,a@test.com,A,A
+2024/02,1,300.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+		{
+			name: "unbounded to",
+			cfg:  Config{From: from},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,a@test.com,A,A
+2024/02,1,700.0000000,GBP,2,b@test.com,B,B
+`,
+		},
+		{
+			name: "unbounded from",
+			cfg:  Config{To: to},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,300.0000000,GBP,2,a@test.com,A,A
+2024/02,1,300.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestTopSpenders_weeklyPeriod(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		// Sunday the 14th ends week 2, Monday the 15th starts week 3.
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 14, 23, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 150, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 15, 1, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 21, 12, 0, 0, 0, time.UTC)},
+		// Monday the 30th of December starts the first week of 2025.
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 50, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 12, 30, 12, 0, 0, 0, time.UTC)},
+	}
+
+	t.Run("ranked per week", func(t *testing.T) {
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024-W02,1,100.0000000,GBP,1,a@test.com,A,A
+2024-W03,1,200.0000000,GBP,1,b@test.com,B,B
+2024-W03,2,150.0000000,GBP,1,a@test.com,A,A
+2025-W01,1,50.0000000,GBP,1,b@test.com,B,B
+`
+		output, err := runTest(t, transactions, Config{Period: PeriodWeek})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+
+	t.Run("ranked per month", func(t *testing.T) {
+		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,250.0000000,GBP,2,a@test.com,A,A
+2024/01,2,200.0000000,GBP,1,b@test.com,B,B
+2024/12,1,50.0000000,GBP,1,b@test.com,B,B
+`
+		output, err := runTest(t, transactions, Config{Period: PeriodMonth})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+
+	t.Run("unknown period", func(t *testing.T) {
+		_, err := runTest(t, transactions, Config{Period: "day"})
+		if err == nil || err.Error() != "unknown period: day" {
+			t.Fatalf("expected an unknown period error, got %v", err)
+		}
+	})
+}
+
+func TestTopSpenders_countRefundsSeparately(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: -30, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 80, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: 1, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txCardSpend, Amount: -0.5, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		cfg         Config
+		expectedCSV string
+	}{
+		{
+			name: "refunds counted separately",
+			cfg:  Config{CountRefundsSeparately: true},
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName,grossGBP,refunds
+2024/01,1,80.0000000,GBP,1,b@test.com,B,B,80.0000000,0
+2024/01,2,70.0000000,GBP,1,a@test.com,A,A,100.0000000,1
+2024/01,3,25.0000000,GBP,1,c@test.com,C,C,50.0000000,1
+`,
+		},
+		{
+			name: "refunds counted as transactions",
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,80.0000000,GBP,1,b@test.com,B,B
+2024/01,2,70.0000000,GBP,2,a@test.com,A,A
+2024/01,3,25.0000000,GBP,2,c@test.com,C,C
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, tc.cfg)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
 A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
-B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
-C,C,c@test.com,CARD SPEND,5013,200,GBP,GBP,1,12/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00
+`
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	if _, err := gz.Write([]byte(csvInput)); err != nil {
+		t.Fatalf("failed to compress input: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("failed to compress input: %v", err)
+	}
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
 `
-		inBuffer := bytes.NewBufferString(csvInput)
-		outBuffer := &bytes.Buffer{}
 
-		cfg := Config{StopOnError: false}
-		err := TopSpenders(inBuffer, outBuffer, cfg)
+	testCases := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "gzip", input: gzipped.Bytes()},
+		{name: "plain", input: []byte(csvInput)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input, err := Decompress(bytes.NewReader(tc.input))
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			outBuffer := &bytes.Buffer{}
+			if err := TopSpenders(input, outBuffer, Config{StopOnError: true}); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if outBuffer.String() != expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+			}
+		})
+	}
 
+	t.Run("corrupt gzip", func(t *testing.T) {
+		// Truncated before the end of the compressed data.
+		input, err := Decompress(bytes.NewReader(gzipped.Bytes()[:gzipped.Len()/2]))
 		if err != nil {
-			t.Fatalf("expected no error, but got: %v", err)
+			t.Fatalf("expected no error, got %v", err)
+		}
+		err = TopSpenders(input, &bytes.Buffer{}, Config{StopOnError: true})
+		if err == nil || !strings.Contains(err.Error(), "invalid gzip input") {
+			t.Fatalf("expected an invalid gzip input error, got %v", err)
 		}
+	})
+}
 
-		// The program should skip the invalid row and produce output for the valid ones.
+func TestTopSpenders_minAmount(t *testing.T) {
+	t.Parallel()
+	transactions := []*Transaction{
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: -40, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, Amount: 0, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 10, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC)},
+		// 0.5 grams are worth 25 GBP.
+		{FirstName: "B", LastName: "B", Email: "b@test.com", TransactionType: txCardSpend, Amount: 0.5, FromCurrency: currencyGGM, ToCurrency: currencyGBP, Rate: 50, Date: time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)},
+	}
+
+	testCases := []struct {
+		name        string
+		minAmount   float64
+		expectedCSV string
+	}{
+		{
+			name: "every amount counted",
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,60.0000000,GBP,3,a@test.com,A,A
+2024/01,2,35.0000000,GBP,2,b@test.com,B,B
+`,
+		},
+		{
+			name:      "negative and zero amounts skipped",
+			minAmount: 0.01,
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+2024/01,2,35.0000000,GBP,2,b@test.com,B,B
+`,
+		},
+		{
+			name:      "threshold in GBP",
+			minAmount: 20,
+			expectedCSV: `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+2024/01,2,25.0000000,GBP,1,b@test.com,B,B
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := runTest(t, transactions, Config{MinAmount: tc.minAmount})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			if output != tc.expectedCSV {
+				t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, tc.expectedCSV)
+			}
+		})
+	}
+
+	t.Run("threshold in the native currency when ranking per currency", func(t *testing.T) {
+		// The 0.5 grams are below the threshold, whatever they are worth in GBP.
 		expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
-2024/01,1,200.0000000,GBP,1,c@test.com,C,C
-2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+2024/01,1,100.0000000,GBP,1,a@test.com,A,A
+2024/01,2,10.0000000,GBP,1,b@test.com,B,B
 `
-		if outBuffer.String() != expectedCSV {
-			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", outBuffer.String(), expectedCSV)
+		output, err := runTest(t, transactions, Config{MinAmount: 1, RankPerCurrency: true})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		if output != expectedCSV {
+			t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+		}
+	})
+}
+
+func TestParseTransactions(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,invalid_amount,GBP,GBP,1,11/01/2024 12:00
+C,C,c@test.com,BUY GOLD,,200,GBP,GGM,50,12/01/2024 12:00
+`
+
+	t.Run("invalid rows are skipped", func(t *testing.T) {
+		errorBuffer := &bytes.Buffer{}
+		transactions, err := ParseTransactions(strings.NewReader(csvInput), Config{ErrorWriter: errorBuffer})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+
+		expected := []*Transaction{
+			{FirstName: "A", LastName: "A", Email: "a@test.com", TransactionType: txCardSpend, MerchantCode: "5013", Amount: 100, FromCurrency: currencyGBP, ToCurrency: currencyGBP, Rate: 1, Date: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+			{FirstName: "C", LastName: "C", Email: "c@test.com", TransactionType: txBuyGold, Amount: 200, FromCurrency: currencyGBP, ToCurrency: currencyGGM, Rate: 50, Date: time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)},
+		}
+		if len(transactions) != len(expected) {
+			t.Fatalf("expected %d transactions, got %d", len(expected), len(transactions))
+		}
+		for i, tx := range transactions {
+			if *tx != *expected[i] {
+				t.Errorf("transaction %d: expected %+v, got %+v", i, *expected[i], *tx)
+			}
+		}
+		if !strings.Contains(errorBuffer.String(), `"line":3`) {
+			t.Errorf("expected the invalid row to be reported, got: %s", errorBuffer.String())
+		}
+	})
+
+	t.Run("stop on error", func(t *testing.T) {
+		transactions, err := ParseTransactions(strings.NewReader(csvInput), Config{StopOnError: true})
+		if err == nil || !strings.HasPrefix(err.Error(), "line 3: ") {
+			t.Fatalf("expected an error on line 3, got %v", err)
+		}
+		if transactions != nil {
+			t.Errorf("expected no transactions, got %d", len(transactions))
 		}
 	})
 }
 
+// blockingReader blocks every read until done is closed, like a stalled
+// upstream.
+type blockingReader struct {
+	done chan struct{}
+}
+
+func (r blockingReader) Read([]byte) (int, error) {
+	<-r.done
+	return 0, io.EOF
+}
+
+// slowReader delays every read, like a slow upstream.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+func TestTopSpenders_slowThreshold(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+`
+	logs := &bytes.Buffer{}
+	cfg := Config{
+		SlowThreshold: time.Millisecond,
+		Logger:        slog.New(slog.NewTextHandler(logs, nil)),
+	}
+	input := slowReader{r: strings.NewReader(csvInput), delay: 10 * time.Millisecond}
+	if err := TopSpenders(input, io.Discard, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if !strings.Contains(logs.String(), `msg="slow processing"`) || !strings.Contains(logs.String(), "rows=1") {
+		t.Errorf("expected a slow processing warning, got logs:\n%s", logs.String())
+	}
+}
+
+func TestTopSpenders_timeBudget(t *testing.T) {
+	t.Parallel()
+	csvInput := `First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date
+A,A,a@test.com,CARD SPEND,5013,100,GBP,GBP,1,10/01/2024 12:00
+B,B,b@test.com,CARD SPEND,5013,200,GBP,GBP,1,11/01/2024 12:00
+`
+	stalled := blockingReader{done: make(chan struct{})}
+	t.Cleanup(func() { close(stalled.done) })
+
+	expectedCSV := `date,rank,amount,currency,transactions,email,firstName,lastName
+2024/01,1,200.0000000,GBP,1,b@test.com,B,B
+2024/01,2,100.0000000,GBP,1,a@test.com,A,A
+`
+	logs := &bytes.Buffer{}
+	cfg := Config{
+		TimeBudget: 50 * time.Millisecond,
+		Logger:     slog.New(slog.NewTextHandler(logs, nil)),
+	}
+	outBuffer := &bytes.Buffer{}
+	if err := TopSpenders(io.MultiReader(strings.NewReader(csvInput), stalled), outBuffer, cfg); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if output := outBuffer.String(); output != expectedCSV {
+		t.Errorf("output csv does not match expected value.\nGot:\n%s\nExpected:\n%s", output, expectedCSV)
+	}
+	if !strings.Contains(logs.String(), `"time budget elapsed, the report is partial" rows=2 lastDate="11/01/2024 12:00"`) {
+		t.Errorf("expected a partial report warning, got logs:\n%s", logs.String())
+	}
+}
+
 func TestTransaction_validate(t *testing.T) {
 	t.Parallel()
 	baseTx := func() *Transaction {
@@ -132,6 +3403,7 @@ func TestTransaction_validate(t *testing.T) {
 
 	testCases := []struct {
 		name    string
+		cfg     Config
 		modFunc func(*Transaction)
 		wantErr bool
 	}{
@@ -161,6 +3433,82 @@ func TestTransaction_validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "gold converted to a currency other than GBP",
+			modFunc: func(tx *Transaction) {
+				tx.FromCurrency = currencyGGM
+				tx.ToCurrency = "USD"
+				tx.Rate = 60
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing rate for GGM",
+			modFunc: func(tx *Transaction) {
+				tx.FromCurrency = currencyGGM
+				tx.ToCurrency = currencyGBP
+				tx.Rate = 0
+			},
+			wantErr: true,
+		},
+		{
+			name: "gold to gold",
+			modFunc: func(tx *Transaction) {
+				tx.FromCurrency = currencyGGM
+				tx.ToCurrency = currencyGGM
+				tx.Rate = 50
+			},
+			wantErr: false,
+		},
+		{
+			name: "missing rate for gold to gold",
+			modFunc: func(tx *Transaction) {
+				tx.FromCurrency = currencyGGM
+				tx.ToCurrency = currencyGGM
+				tx.Rate = 0
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty name accepted by default",
+			modFunc: func(tx *Transaction) {
+				tx.FirstName = ""
+			},
+			wantErr: false,
+		},
+		{
+			name: "empty name rejected when names are required",
+			cfg:  Config{RequireNames: true},
+			modFunc: func(tx *Transaction) {
+				tx.LastName = ""
+			},
+			wantErr: true,
+		},
+		{
+			name: "date before the minimum date",
+			cfg:  Config{MinDate: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+			modFunc: func(tx *Transaction) {
+				tx.Date = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+			},
+			wantErr: true,
+		},
+		{
+			name: "date after the minimum date",
+			cfg:  Config{MinDate: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+			modFunc: func(tx *Transaction) {
+				tx.Date = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+			},
+			wantErr: false,
+		},
+		{
+			name: "names present when required",
+			cfg:  Config{RequireNames: true},
+			modFunc: func(tx *Transaction) {
+				tx.FirstName = "A"
+				tx.LastName = "A"
+			},
+			wantErr: false,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -168,7 +3516,7 @@ func TestTransaction_validate(t *testing.T) {
 			tx := baseTx()
 			tc.modFunc(tx)
 
-			err := tx.validate()
+			err := tx.validate(&tc.cfg)
 			if (err != nil) != tc.wantErr {
 				t.Errorf("Transaction.validate() error = %v, wantErr %v", err, tc.wantErr)
 			}
@@ -215,3 +3563,23 @@ func runTest(t *testing.T, transactions []*Transaction, cfg Config) (string, err
 
 	return outBuffer.String(), err
 }
+
+func BenchmarkTopSpenders(b *testing.B) {
+	input := &bytes.Buffer{}
+	input.WriteString("First name,Last name,Email,Description,Merchant code,Amount,From Currency,To Currency,Rate,Date\n")
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(input, "A,A,user%d@test.com,CARD SPEND,5013,%d,GBP,GBP,1,%02d/01/2024 12:00\n", i%100, i, i%28+1)
+	}
+
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse transactions %v", reuse), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := TopSpenders(bytes.NewReader(input.Bytes()), io.Discard, Config{ReuseTransactions: reuse})
+				if err != nil {
+					b.Fatalf("expected no error, got %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package parse
+
+import (
+	"fmt"
+	"io"
+)
+
+// TemplateMonth is the data Config.OutputTemplate is executed with, once
+// per month of the report.
+type TemplateMonth struct {
+	// Month is the month as written in the date column, e.g. 2024/01.
+	Month string
+	// Rows holds the ranked rows of the month, like the JSON output formats.
+	Rows []Row
+}
+
+// writeTemplate writes the rankings by executing cfg.OutputTemplate for
+// every month.
+func writeTemplate(rankings []*monthRanking, w io.Writer, cfg Config) error {
+	for _, ranking := range rankings {
+		month := TemplateMonth{
+			Month: cfg.periodLabel(ranking.month),
+			Rows:  make([]Row, 0, len(ranking.rows)),
+		}
+		for _, r := range ranking.rows {
+			month.Rows = append(month.Rows, newRow(r, cfg))
+		}
+		if err := cfg.OutputTemplate.Execute(w, month); err != nil {
+			return fmt.Errorf("executing output template: %w", err)
+		}
+	}
+	return nil
+}